@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// NewFindings returns the findings in head that base doesn't have, e.g. to
+// only report the violations a pull request introduces when base is the
+// template on the target branch.  Findings are the same when they come from
+// the same query, have the same message and resource, and depend on the same
+// paths.  Lines and document numbers are not compared, so moving things
+// around in the template doesn't report them again.  The results themselves
+// are not changed.
+func NewFindings(head []*Result, base []*Result) []*Result {
+	known := map[string]int{}
+	for _, result := range base {
+		for _, finding := range result.Findings {
+			known[findingKey(result, finding)]++
+		}
+	}
+
+	results := []*Result{}
+	for _, result := range head {
+		added := *result
+		added.Findings = nil
+		added.Locations, added.Unresolved = []Location{}, []Path{}
+		unresolved := map[string]bool{}
+		for _, finding := range result.Findings {
+			key := findingKey(result, finding)
+			if known[key] > 0 {
+				// Every finding in base accounts for one in head.
+				known[key]--
+				continue
+			}
+			added.Findings = append(added.Findings, finding)
+			added.Locations = append(added.Locations, finding.Locations...)
+			for _, path := range finding.Unresolved {
+				if !unresolved[path.Pointer()] {
+					unresolved[path.Pointer()] = true
+					added.Unresolved = append(added.Unresolved, path)
+				}
+			}
+		}
+		added.Locations = sortLocations(added.Locations)
+		results = append(results, &added)
+	}
+	return results
+}
+
+// findingKey identifies a finding across versions of a template.
+func findingKey(result *Result, finding Finding) string {
+	pointers := []string{}
+	for _, location := range finding.Locations {
+		pointers = append(pointers, location.Path.Pointer())
+	}
+	for _, path := range finding.Unresolved {
+		pointers = append(pointers, path.Pointer())
+	}
+	sort.Strings(pointers)
+	resource := ""
+	if result.Resource != nil {
+		resource = result.Resource.String()
+	}
+	return strings.Join(append([]string{result.Query, finding.Message, resource}, pointers...), "\x00")
+}
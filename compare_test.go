@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewFindings(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	container := input.spec.containers[_]
+	container.securityContext.privileged
+	msg := sprintf("%s is privileged", [container.name])
+}
+`)
+	base := filepath.Join(dir, "base.yml")
+	writeFile(t, base, `spec:
+  containers:
+    - name: app
+      securityContext: {privileged: true}
+`)
+	// The existing finding moves down a few lines, and a new container is
+	// privileged too.
+	head := filepath.Join(dir, "head.yml")
+	writeFile(t, head, `# Added a sidecar.
+
+spec:
+  containers:
+    - name: app
+      securityContext: {privileged: true}
+    - name: sidecar
+      securityContext: {privileged: true}
+`)
+	scanner, err := NewScanner([]string{policy}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseResults, err := scanner.Scan(context.Background(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headResults, err := scanner.Scan(context.Background(), head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := NewFindings(headResults, baseResults)
+	messages := []string{}
+	for _, result := range added {
+		for _, finding := range result.Findings {
+			messages = append(messages, finding.Message)
+		}
+	}
+	if !reflect.DeepEqual(messages, []string{"sidecar is privileged"}) {
+		t.Errorf("expected only the sidecar to be new, got %v", messages)
+	}
+	if len(headResults[0].Findings) != 2 {
+		t.Error("NewFindings changed the results")
+	}
+	if len(NewFindings(baseResults, baseResults)[0].Findings) != 0 {
+		t.Error("expected no new findings when comparing a template to itself")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build opa_wasm
+
+package main
+
+// Registers OPA's WebAssembly engine, see Options.Wasm.
+import _ "github.com/open-policy-agent/opa/features/wasm"
+
+// wasmEngine reports whether policies can be evaluated as WebAssembly.
+const wasmEngine = true
@@ -0,0 +1,7 @@
+//go:build !opa_wasm
+
+package main
+
+// wasmEngine reports whether policies can be evaluated as WebAssembly.  That
+// takes a build with `-tags opa_wasm`, which needs cgo.
+const wasmEngine = false
@@ -0,0 +1,84 @@
+//go:build opa_wasm
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/compile"
+)
+
+// TestWasm checks that evaluating the queries as WebAssembly finds the same
+// locations as topdown, both for failing and passing documents.
+func TestWasm(t *testing.T) {
+	policy := `package policy
+
+deny[msg] {
+	container := input.spec.containers[_]
+	not container.resources.limits.memory
+	msg := sprintf("%s has no memory limit", [container.name])
+}
+`
+	template := `spec:
+  containers:
+    - name: app
+      resources: {limits: {memory: 1Gi}}
+    - name: sidecar
+      image: proxy
+---
+spec:
+  containers: []
+`
+	expected := infer(t, policy, "template.yml", template, Options{})
+	if len(expected) == 0 {
+		t.Fatal("expected the sidecar to fail the policy")
+	}
+	found := infer(t, policy, "template.yml", template, Options{Wasm: true})
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v with WebAssembly, expected %v", found, expected)
+	}
+}
+
+// TestWasmBundle checks that the entrypoints of a precompiled bundle are
+// reported at the whole document, while the other policies are still traced.
+func TestWasmBundle(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "policy.rego"), `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "run at least two replicas"
+}
+`)
+	var buffer bytes.Buffer
+	compiler := compile.New().
+		WithTarget(compile.TargetWasm).
+		WithEntrypoints("policy/deny").
+		WithRoots("policy").
+		WithPaths(dir).
+		WithOutput(&buffer)
+	if err := compiler.Build(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	writeFile(t, bundle, buffer.String())
+
+	found := infer(t, `package checks
+
+deny[msg] {
+	endswith(input.spec.image, ":latest")
+	msg := "pin the image"
+}
+`, "template.yml", "spec:\n  replicas: 1\n  image: app:latest\n", Options{WasmBundle: bundle})
+	expected := map[string][]string{
+		"run at least two replicas": {"@1:1"},
+		"pin the image":             {"spec.image@3:10"},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The errors below tell apart the stages in which scanning can fail.  They
+// all wrap the underlying cause, so errors.Is and errors.As still work on it.
+
+// ReadError is returned when a template, policy or data file can't be read.
+type ReadError struct {
+	File string
+	Err  error
+}
+
+func (err *ReadError) Error() string { return fileError(err.File, err.Err) }
+func (err *ReadError) Unwrap() error { return err.Err }
+
+// ParseError is returned when a template or policy is not valid YAML, JSON
+// or rego, or when a template holds no documents or not the one selected by
+// Options.Document.
+type ParseError struct {
+	File string
+	Err  error
+}
+
+func (err *ParseError) Error() string { return fileError(err.File, err.Err) }
+func (err *ParseError) Unwrap() error { return err.Err }
+
+// CompileError is returned when the policy fails to compile.  File is the
+// first file the compiler complained about.
+type CompileError struct {
+	File string
+	Err  error
+}
+
+func (err *CompileError) Error() string { return fileError(err.File, err.Err) }
+func (err *CompileError) Unwrap() error { return err.Err }
+
+// EvalError is returned when evaluating the policy against a template fails,
+// including when the evaluation is cancelled or times out.
+type EvalError struct {
+	File string
+	Err  error
+}
+
+func (err *EvalError) Error() string { return fileError(err.File, err.Err) }
+func (err *EvalError) Unwrap() error { return err.Err }
+
+// fileError prefixes a message with the file, unless the underlying error
+// already mentions it, as e.g. errors from os and the rego parser do.
+func fileError(file string, err error) string {
+	if file == "" || strings.Contains(err.Error(), file) {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s: %s", file, err)
+}
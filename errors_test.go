@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrors(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, "package policy\n\ndeny[msg] {\n\tinput.name == \"web\"\n\tmsg := \"web\"\n}\n")
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "name: web\n")
+
+	second := 1
+	for _, test := range []struct {
+		name     string
+		policy   string
+		template string
+		text     string
+		options  Options
+		check    func(error) bool
+		message  string
+	}{
+		{
+			name:     "missing template",
+			template: filepath.Join(dir, "missing.yml"),
+			check:    func(err error) bool { var e *ReadError; return errors.As(err, &e) && e.File != "" },
+		},
+		{
+			name:   "missing policy",
+			policy: filepath.Join(dir, "missing.rego"),
+			check:  func(err error) bool { var e *ReadError; return errors.As(err, &e) },
+		},
+		{
+			name:  "invalid yaml",
+			text:  "name: [web\n",
+			check: func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+		},
+		{
+			// Objects need scalar keys.
+			name:    "sequence key",
+			text:    "? [a, b]\n: 1\n",
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "invalid map key",
+		},
+		{
+			name:    "recursive alias",
+			text:    "a: &x [*x]\n",
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "contains itself",
+		},
+		{
+			name:    "empty",
+			text:    "# nothing here\n",
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "empty document",
+		},
+		{
+			// YAML and JSON get a warning instead, see TestDuplicateKeys.
+			name:     "duplicate toml keys",
+			template: "template.toml",
+			text:     "name = \"web\"\nname = \"api\"\n",
+			check:    func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message:  `line 2, column 1: key "name" already defined at line 1, column 1`,
+		},
+		{
+			name:     "duplicate hcl attributes",
+			template: "main.tf",
+			text:     "name = \"web\"\nname = \"api\"\n",
+			check:    func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message:  `The argument "name" was already set`,
+		},
+		{
+			// The error points to the value that can't be decoded.
+			name:    "invalid binary",
+			text:    "a: !!binary \"@@\"\n",
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "line 1, column 13 at a: yaml: !!binary value contains invalid base64 data",
+		},
+		{
+			name:    "invalid int",
+			text:    "spec:\n  replicas: !!int abc\n",
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "line 2, column 19 at spec.replicas:",
+		},
+		{
+			name:    "no such document",
+			text:    "name: web\n",
+			options: Options{Document: &second},
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "there is no document 1, the template has 1",
+		},
+		{
+			name:    "too deep",
+			text:    "a:\n  b:\n    c:\n      d: 1\n",
+			options: Options{MaxDepth: 2},
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "nested deeper than 2 levels",
+		},
+		{
+			// Flow collections nest without indentation, so they can be
+			// very deep in a small template.
+			name:    "very deep",
+			text:    "a: " + strings.Repeat("[", 5000) + strings.Repeat("]", 5000) + "\n",
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "document 0: nested deeper than 1000 levels",
+		},
+		{
+			name:    "invalid rego",
+			policy:  "package policy\n\ndeny[msg] {\n",
+			check:   func(err error) bool { var e *ParseError; return errors.As(err, &e) },
+			message: "rego_parse_error",
+		},
+		{
+			// The diagnostic quotes the offending line of the policy.
+			name:    "undefined function",
+			policy:  "package policy\n\ndeny[msg] {\n\tundefined_fn(input.name)\n\tmsg := \"x\"\n}\n",
+			check:   func(err error) bool { var e *CompileError; return errors.As(err, &e) && e.File != "" },
+			message: "policy.rego:4: rego_type_error: undefined function undefined_fn\n\tundefined_fn(input.name)",
+		},
+		{
+			name:    "conflict",
+			policy:  "package policy\n\nname = 1 { input.name }\nname = 2 { input.name }\n\ndeny[msg] {\n\tname\n\tmsg := \"x\"\n}\n",
+			check:   func(err error) bool { var e *EvalError; return errors.As(err, &e) },
+			message: "eval_conflict_error",
+		},
+	} {
+		policy, template := policy, template
+		if strings.HasSuffix(test.policy, ".rego") {
+			policy = test.policy
+		} else if test.policy != "" {
+			policy = filepath.Join(t.TempDir(), "policy.rego")
+			writeFile(t, policy, test.policy)
+		}
+		if filepath.IsAbs(test.template) {
+			template = test.template
+		} else if test.text != "" {
+			name := test.template
+			if name == "" {
+				name = "template.yml"
+			}
+			template = filepath.Join(t.TempDir(), name)
+			writeFile(t, template, test.text)
+		}
+		_, err := Infer(context.Background(), policy, template, test.options)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if !test.check(err) {
+			t.Errorf("%s: unexpected error type %T: %s", test.name, err, err)
+		} else if !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected %q in the error, got: %s", test.name, test.message, err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.name == "web"
+	count([x | x := numbers.range(1, 100000000)[_]; x % 7 == 0]) > 0
+	msg := "slow"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "name: web\n")
+	scanner, err := NewScanner([]string{policy}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = scanner.Scan(ctx, template)
+	var evalErr *EvalError
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &evalErr) {
+		t.Fatalf("expected an EvalError for the deadline, got %T: %v", err, err)
+	} else if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("evaluation only stopped after %s", elapsed)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"gopkg.in/yaml.v3"
+)
+
+// isHCL checks whether a file should be parsed as HCL, e.g. Terraform.
+func isHCL(file string) bool {
+	ext := extension(file)
+	return ext == ".tf" || ext == ".hcl"
+}
+
+// hclBuilder converts an HCL file to a tree of YAML nodes, like tomlBuilder,
+// so the input can be decoded from the nodes in the same way as for YAML.
+//
+// Blocks are nested under their type and labels, so
+// `resource "aws_s3_bucket" "logs" { ... }` becomes
+// `input.resource.aws_s3_bucket.logs`.  Blocks without labels, such as
+// `ingress` in a security group, may be repeated and become arrays.
+//
+// We don't evaluate the configuration, there are no variables or functions.
+// Expressions that can't be evaluated without them, such as references to
+// other resources, become strings holding their source text in `${...}`.
+type hclBuilder struct {
+	source *Source
+}
+
+// parseHCL builds the single document of an HCL source.
+func (source *Source) parseHCL() error {
+	file, diags := hclsyntax.ParseConfig(source.bytes, source.file, hcl.InitialPos)
+	if diags.HasErrors() {
+		return diags
+	}
+	builder := &hclBuilder{source: source}
+	body := file.Body.(*hclsyntax.Body)
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Line: 1, Column: 1}
+	if len(body.Attributes) > 0 || len(body.Blocks) > 0 {
+		root := builder.node(yaml.MappingNode, "!!map", body.SrcRange)
+		builder.body(root, body)
+		doc.Content = []*yaml.Node{root}
+	}
+	source.docs = append(source.docs, doc)
+	return nil
+}
+
+// body adds the attributes and blocks of a body to a mapping, in the order
+// they appear in the source.
+func (builder *hclBuilder) body(mapping *yaml.Node, body *hclsyntax.Body) {
+	attributes := []*hclsyntax.Attribute{}
+	for _, attribute := range body.Attributes {
+		attributes = append(attributes, attribute)
+	}
+	sort.Slice(attributes, func(i, j int) bool {
+		return attributes[i].SrcRange.Start.Byte < attributes[j].SrcRange.Start.Byte
+	})
+	for _, attribute := range attributes {
+		key := builder.key(attribute.Name, attribute.NameRange)
+		mapping.Content = append(mapping.Content, key, builder.expression(attribute.Expr))
+	}
+
+	for _, block := range body.Blocks {
+		rng := hcl.RangeBetween(block.TypeRange, block.CloseBraceRange)
+		keys := append([]string{block.Type}, block.Labels...)
+		ranges := append([]hcl.Range{block.TypeRange}, block.LabelRanges...)
+		parent := mapping
+		for i, k := range keys {
+			kind, tag := yaml.MappingNode, "!!map"
+			if i == len(keys)-1 && len(block.Labels) == 0 {
+				kind, tag = yaml.SequenceNode, "!!seq"
+			}
+			_, child, _ := lookup(parent, k)
+			if child == nil {
+				child = builder.node(kind, tag, hcl.RangeBetween(ranges[i], block.CloseBraceRange))
+				parent.Content = append(parent.Content, builder.key(k, ranges[i]), child)
+			} else {
+				// E.g. the `resource` of a second resource block.
+				builder.extend(child, rng)
+			}
+			parent = child
+		}
+		if parent.Kind == yaml.SequenceNode {
+			element := builder.node(yaml.MappingNode, "!!map", rng)
+			parent.Content = append(parent.Content, element)
+			parent = element
+		}
+		builder.body(parent, block.Body)
+	}
+}
+
+// extend makes a node span up to the end of a range, if it doesn't already.
+func (builder *hclBuilder) extend(node *yaml.Node, rng hcl.Range) {
+	line, column := builder.source.position(rng.End.Byte)
+	end := builder.source.ends[node]
+	if line > end[0] || line == end[0] && column > end[1] {
+		builder.source.ends[node] = [2]int{line, column}
+	}
+}
+
+func (builder *hclBuilder) key(name string, rng hcl.Range) *yaml.Node {
+	node := builder.node(yaml.ScalarNode, "!!str", rng)
+	node.Value = name
+	if bytes.HasPrefix(rng.SliceBytes(builder.source.bytes), []byte(`"`)) {
+		node.Style = yaml.DoubleQuotedStyle
+	}
+	return node
+}
+
+// expression converts an attribute value.  Tuples and objects are taken
+// apart so their elements get their own positions.
+func (builder *hclBuilder) expression(expr hclsyntax.Expression) *yaml.Node {
+	switch expr := expr.(type) {
+	case *hclsyntax.TupleConsExpr:
+		node := builder.node(yaml.SequenceNode, "!!seq", expr.Range())
+		node.Style = yaml.FlowStyle
+		for _, elem := range expr.Exprs {
+			node.Content = append(node.Content, builder.expression(elem))
+		}
+		return node
+	case *hclsyntax.ObjectConsExpr:
+		node := builder.node(yaml.MappingNode, "!!map", expr.Range())
+		node.Style = yaml.FlowStyle
+		for _, item := range expr.Items {
+			key, diags := item.KeyExpr.Value(nil)
+			if diags.HasErrors() || key.IsNull() || !key.IsKnown() || key.Type() != cty.String {
+				key = cty.StringVal(builder.text(item.KeyExpr.Range()))
+			}
+			node.Content = append(node.Content,
+				builder.key(key.AsString(), item.KeyExpr.Range()),
+				builder.expression(item.ValueExpr))
+		}
+		return node
+	}
+
+	value, diags := expr.Value(nil)
+	if diags.HasErrors() || !value.IsWhollyKnown() {
+		node := builder.node(yaml.ScalarNode, "!!str", expr.Range())
+		node.Value = builder.text(expr.Range())
+		if _, ok := expr.(*hclsyntax.TemplateExpr); !ok {
+			node.Value = "${" + node.Value + "}"
+		}
+		return node
+	}
+	node := builder.value(value, expr.Range())
+	if _, ok := expr.(*hclsyntax.TemplateExpr); ok &&
+		bytes.HasPrefix(expr.Range().SliceBytes(builder.source.bytes), []byte(`"`)) {
+		node.Style = yaml.DoubleQuotedStyle
+	}
+	return node
+}
+
+// text is the source text of a range.  Templates keep their interpolations
+// but lose their quotes.
+func (builder *hclBuilder) text(rng hcl.Range) string {
+	text := rng.SliceBytes(builder.source.bytes)
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		text = text[1 : len(text)-1]
+	}
+	return string(text)
+}
+
+// value converts an evaluated value.  All its nodes span the expression it
+// came from, since there's nothing more precise.
+func (builder *hclBuilder) value(value cty.Value, rng hcl.Range) *yaml.Node {
+	ty := value.Type()
+	switch {
+	case value.IsNull():
+		return builder.node(yaml.ScalarNode, "!!null", rng)
+	case ty == cty.String:
+		node := builder.node(yaml.ScalarNode, "!!str", rng)
+		node.Value = value.AsString()
+		return node
+	case ty == cty.Bool:
+		node := builder.node(yaml.ScalarNode, "!!bool", rng)
+		node.Value = "false"
+		if value.True() {
+			node.Value = "true"
+		}
+		return node
+	case ty == cty.Number:
+		number := value.AsBigFloat()
+		node := builder.node(yaml.ScalarNode, "!!float", rng)
+		node.Value = number.Text('g', -1)
+		if number.IsInt() {
+			node.Tag, node.Value = "!!int", number.Text('f', 0)
+		}
+		return node
+	case ty.IsObjectType() || ty.IsMapType():
+		node := builder.node(yaml.MappingNode, "!!map", rng)
+		node.Style = yaml.FlowStyle
+		for it := value.ElementIterator(); it.Next(); {
+			k, v := it.Element()
+			key := builder.node(yaml.ScalarNode, "!!str", rng)
+			key.Value = k.AsString()
+			node.Content = append(node.Content, key, builder.value(v, rng))
+		}
+		return node
+	case ty.IsListType() || ty.IsSetType() || ty.IsTupleType():
+		node := builder.node(yaml.SequenceNode, "!!seq", rng)
+		node.Style = yaml.FlowStyle
+		for it := value.ElementIterator(); it.Next(); {
+			_, v := it.Element()
+			node.Content = append(node.Content, builder.value(v, rng))
+		}
+		return node
+	}
+	node := builder.node(yaml.ScalarNode, "!!str", rng)
+	node.Value = builder.text(rng)
+	return node
+}
+
+// node creates a node spanning a range of the input.
+func (builder *hclBuilder) node(kind yaml.Kind, tag string, rng hcl.Range) *yaml.Node {
+	node := &yaml.Node{Kind: kind, Tag: tag}
+	node.Line, node.Column = builder.source.position(rng.Start.Byte)
+	endLine, endColumn := builder.source.position(rng.End.Byte)
+	builder.source.ends[node] = [2]int{endLine, endColumn}
+	return node
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHCL(t *testing.T) {
+	findings := infer(t, `package policy
+
+deny[msg] {
+	bucket := input.resource.aws_s3_bucket[name]
+	bucket.acl == "public-read"
+	msg := sprintf("%s is public", [name])
+}
+`, "main.tf", `resource "aws_s3_bucket" "logs" {
+  bucket = "logs"
+  acl    = "private"
+}
+
+resource "aws_s3_bucket" "site" {
+  bucket = "site"
+  acl    = "public-read"
+}
+`, Options{})
+	expected := map[string][]string{
+		"site is public": {"resource.aws_s3_bucket.site.acl@8:13"},
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("got %v, expected %v", findings, expected)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Ignore suppresses findings that are known and accepted, without having to
+// change the policy.  An ignore file is a YAML or JSON list of these, e.g.:
+//
+//	[
+//	  {"rule": "policy.deny", "path": "/Resources/PublicSubnet/Properties/CidrBlock"},
+//	  {"path": "/Resources/*/Properties/MapPublicIpOnLaunch"}
+//	]
+type Ignore struct {
+	// Rule is the query, with or without the `data.` prefix.  Empty
+	// matches every query.
+	Rule string `yaml:"rule"`
+	// Path is a JSON pointer to an attribute.  Segments may use the
+	// wildcards of path.Match, e.g. `/Resources/*/Type`.  Empty matches
+	// every attribute.
+	Path string `yaml:"path"`
+}
+
+// LoadIgnores reads an ignore file.
+func LoadIgnores(file string) ([]Ignore, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, &ReadError{File: file, Err: err}
+	}
+	ignores := []Ignore{}
+	if err := yaml.Unmarshal(data, &ignores); err != nil {
+		return nil, &ParseError{File: file, Err: err}
+	}
+	return ignores, nil
+}
+
+func (ignore Ignore) matchRule(query string) bool {
+	return ignore.Rule == "" || ignore.Rule == query ||
+		ignore.Rule == strings.TrimPrefix(query, "data.")
+}
+
+func (ignore Ignore) matchPath(p Path) bool {
+	if ignore.Path == "" {
+		return true
+	}
+	pointer := p.Pointer()
+	ok, _ := path.Match(ignore.Path, pointer)
+	return ok || ignore.Path == pointer
+}
+
+// applyIgnores drops the locations of a finding that are ignored for a
+// query.  It returns whether to keep the finding, which is not the case when
+// every location in it is ignored.
+func applyIgnores(ignores []Ignore, query string, finding *Finding) bool {
+	applies := []Ignore{}
+	for _, ignore := range ignores {
+		if ignore.matchRule(query) {
+			if ignore.Path == "" {
+				return false
+			}
+			applies = append(applies, ignore)
+		}
+	}
+	if len(applies) == 0 || len(finding.Locations) == 0 {
+		return true
+	}
+
+	locations := []Location{}
+	for _, location := range finding.Locations {
+		ignored := false
+		for _, ignore := range applies {
+			ignored = ignored || ignore.matchPath(location.Path)
+		}
+		if !ignored {
+			locations = append(locations, location)
+		}
+	}
+	finding.Locations = locations
+	return len(locations) > 0
+}
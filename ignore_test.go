@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyIgnores(t *testing.T) {
+	finding := func() *Finding {
+		return &Finding{Locations: []Location{
+			{Path: Path{"Resources", "Public", "Properties", "CidrBlock"}},
+			{Path: Path{"Resources", "Private", "Properties", "CidrBlock"}},
+		}}
+	}
+	for _, test := range []struct {
+		name    string
+		ignores []Ignore
+		keep    bool
+		paths   []string
+	}{
+		{"none", nil, true, []string{"/Resources/Public/Properties/CidrBlock", "/Resources/Private/Properties/CidrBlock"}},
+		{"exact", []Ignore{{Path: "/Resources/Public/Properties/CidrBlock"}}, true, []string{"/Resources/Private/Properties/CidrBlock"}},
+		{"glob", []Ignore{{Path: "/Resources/*/Properties/CidrBlock"}}, false, nil},
+		{"rule", []Ignore{{Rule: "policy.deny"}}, false, nil},
+		{"other rule", []Ignore{{Rule: "policy.warn", Path: "/Resources/Public/Properties/CidrBlock"}}, true, []string{"/Resources/Public/Properties/CidrBlock", "/Resources/Private/Properties/CidrBlock"}},
+	} {
+		f := finding()
+		keep := applyIgnores(test.ignores, "data.policy.deny", f)
+		if keep != test.keep {
+			t.Errorf("%s: applyIgnores = %t, expected %t", test.name, keep, test.keep)
+		} else if !keep {
+			continue
+		}
+		paths := []string{}
+		for _, location := range f.Locations {
+			paths = append(paths, location.Path.Pointer())
+		}
+		if !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: kept %v, expected %v", test.name, paths, test.paths)
+		}
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	dir := t.TempDir()
+	ignores := filepath.Join(dir, "ignore.yml")
+	writeFile(t, ignores, "- rule: policy.deny\n  path: /Resources/PrivateSubnet/Properties/CidrBlock\n")
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	cidr := input.Resources[name].Properties.CidrBlock
+	endswith(cidr, "/16")
+	msg := name
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, `Resources:
+  PublicSubnet:
+    Properties:
+      CidrBlock: 10.0.0.0/16
+  PrivateSubnet:
+    Properties:
+      CidrBlock: 10.1.0.0/16
+`)
+	options := Options{}
+	var err error
+	if options.Ignore, err = LoadIgnores(ignores); err != nil {
+		t.Fatal(err)
+	}
+	results, err := Infer(context.Background(), policy, template, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []string{}
+	for _, finding := range results[0].Findings {
+		messages = append(messages, finding.Message)
+	}
+	if !reflect.DeepEqual(messages, []string{"PublicSubnet"}) {
+		t.Errorf("expected only the PublicSubnet finding, got %v", messages)
+	}
+}
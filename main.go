@@ -1,76 +1,795 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
+	"log"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/loader"
 	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
 	"github.com/open-policy-agent/opa/topdown"
 	"gopkg.in/yaml.v3"
 )
 
+// Location is a position in a source file.  The end position is exclusive,
+// it points just after the last character.  Lines and columns are 1-based,
+// and columns count characters (Unicode code points) rather than bytes, so
+// `名前: x` has its value at column 5.  This is what yaml.v3 reports, and we
+// convert TOML and HCL positions to match.
 type Location struct {
-	File   string
-	Line   int
-	Column int
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"endLine"`
+	EndColumn int    `json:"endColumn"`
+	Path      Path   `json:"path"`
+	// Key is set when the location points to the key of an object
+	// attribute rather than to its value, see Options.Keys.
+	Key bool `json:"key,omitempty"`
+	// Value as written in the source, or a summary for objects and arrays.
+	Value string `json:"value"`
+	// Synthetic is set when the value contains a placeholder for a template
+	// expression, see Options.Templated.  Value is the template text then,
+	// e.g. `{{ .Values.image }}`.
+	Synthetic bool `json:"synthetic,omitempty"`
+	// Explanation lists the rego expressions that read the value, see
+	// Options.Explain.
+	Explanation []Step `json:"explanation,omitempty"`
+	// Comment is the comment right above the attribute in the source,
+	// without the `#`s, e.g. to explain why a value was chosen.
+	Comment string `json:"comment,omitempty"`
+
+	// Which components of Path index an array, see Rego.
+	arrays []bool
 }
 
 func (loc Location) String() string {
 	return fmt.Sprintf("%s:%d:%d", loc.File, loc.Line, loc.Column)
 }
 
+// Rego renders the path of a location as a rego reference, e.g.
+// `input.spec.containers[0].image`.  Unlike Path.String, it knows whether a
+// number indexes an array, so the `80` in `ports: {80: http}` is
+// `input.ports["80"]`.  Like the path, the reference starts at the document,
+// which is the input unless Options.Root or Options.Wrap change that.
+func (loc Location) Rego() string {
+	if ref := loc.ref(); ref != "" && !strings.HasPrefix(ref, "[") {
+		return "input." + ref
+	}
+	return "input" + loc.ref()
+}
+
+// ref renders the path of a location for display, e.g.
+// `spec.containers[0].image`.
+func (loc Location) ref() string {
+	return loc.Path.format(loc.arrays)
+}
+
+// Line is a line of source text with its 1-based number.
+type Line struct {
+	Number int    `json:"number"`
+	Text   string `json:"text"`
+}
+
+// WithContext returns the lines of a location in its source, plus up to n
+// lines before and after it, e.g. to quote it in a review comment.  The
+// lines are the ones the location refers to, see Source.Lines.
+func (loc Location) WithContext(source *Source, n int) []Line {
+	lines := source.Lines()
+	end := loc.EndLine
+	if end < loc.Line {
+		end = loc.Line
+	}
+	first, last := loc.Line-n, end+n
+	if first < 1 {
+		first = 1
+	}
+	if last > len(lines) {
+		last = len(lines)
+	}
+	if first > last {
+		return []Line{}
+	}
+	// Copy them so callers can't change the cached lines.
+	return append([]Line{}, lines[first-1:last]...)
+}
+
+// MarshalJSON adds the path in its JSON Pointer and rego forms, for
+// consumers that don't want to deal with the array.
+func (loc Location) MarshalJSON() ([]byte, error) {
+	type location Location
+	return json.Marshal(struct {
+		location
+		Pointer string `json:"pointer"`
+		Rego    string `json:"rego"`
+	}{location(loc), loc.Path.Pointer(), loc.Rego()})
+}
+
+// sortLocations sorts locations by file, line and column, and drops
+// duplicates so the output is deterministic.
+func sortLocations(locations []Location) []Location {
+	sort.Slice(locations, func(i, j int) bool {
+		a, b := locations[i], locations[j]
+		if a.File != b.File {
+			return a.File < b.File
+		} else if a.Line != b.Line {
+			return a.Line < b.Line
+		} else if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return strings.Join(a.Path, "\x00") < strings.Join(b.Path, "\x00")
+	})
+	out := locations[:0]
+	for i, loc := range locations {
+		if i > 0 && loc.String() == locations[i-1].String() {
+			continue
+		}
+		out = append(out, loc)
+	}
+	return out
+}
+
+// Path points to a subdocument.  Object keys are used as they are, and array
+// indices are stored in decimal, e.g. `spec.containers[0].image` becomes
+// Path{"spec", "containers", "0", "image"}.  Resolving a path in the document
+// tells an index apart from a key like `80`, the path alone doesn't, see
+// Location.Rego.
 type Path []string
 
+// Pointer renders the path as a JSON Pointer (RFC 6901), e.g.
+// `/spec/containers/0/image`.
+func (path Path) Pointer() string {
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	var builder strings.Builder
+	for _, component := range path {
+		builder.WriteString("/")
+		builder.WriteString(escaper.Replace(component))
+	}
+	return builder.String()
+}
+
+// String renders the path for display, e.g. `spec.containers[0].image`.
+// Components that are not identifiers are quoted, e.g.
+// `metadata.labels["app.kubernetes.io/name"]`.  Numbers are shown as array
+// indices, since the path doesn't say whether they are.
+func (path Path) String() string {
+	return path.format(nil)
+}
+
+// format renders a path like String, using arrays to tell which components
+// are array indices if it is not nil.
+func (path Path) format(arrays []bool) string {
+	var builder strings.Builder
+	for i, component := range path {
+		index := i < len(arrays) && arrays[i]
+		if arrays == nil {
+			_, err := strconv.Atoi(component)
+			index = err == nil
+		}
+		if index {
+			fmt.Fprintf(&builder, "[%s]", component)
+		} else if identifier.MatchString(component) {
+			if i > 0 {
+				builder.WriteString(".")
+			}
+			builder.WriteString(component)
+		} else {
+			fmt.Fprintf(&builder, "[%s]", strconv.Quote(component))
+		}
+	}
+	return builder.String()
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 type Source struct {
-	file string
-	root *yaml.Node
+	file  string
+	bytes []byte
+	lines [][]rune
+	docs  []*yaml.Node
+	// End positions that are known up front rather than computed by end.
+	ends map[*yaml.Node][2]int
+	// Scalars that contain placeholders, see Options.Templated.  The bytes
+	// are what we parsed then, but the lines are the template text.
+	synthetic map[*yaml.Node]bool
+	// The keys that mappings in each document have more than once, see
+	// removeDuplicates.
+	duplicates [][]duplicate
+	// The lines as strings, built by Lines when first needed.
+	numbered []Line
+}
+
+// Stdin can be passed instead of a file name to read from standard input.
+const Stdin = "-"
+
+// unwrap decodes base64 if requested, and then decompresses gzip data, which
+// we recognize by its magic number rather than by the extension so it also
+// works for stdin.
+func unwrap(data []byte, decode bool) ([]byte, error) {
+	if decode {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, err
+		}
+		data = decoded
+	}
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+	return data, nil
 }
 
+// extension returns the extension that determines the format of a template,
+// looking through a `.gz` and `.j2` suffix, e.g. `.json` for
+// `template.json.gz` and `.yaml` for `values.yaml.j2`.
+func extension(file string) string {
+	return filepath.Ext(strings.TrimSuffix(strings.TrimSuffix(file, ".gz"), ".j2"))
+}
+
+// relativeFile makes a file relative to a base directory, see Options.Base.
+func relativeFile(base string, file string) string {
+	absBase, errBase := filepath.Abs(base)
+	absFile, errFile := filepath.Abs(file)
+	if errBase != nil || errFile != nil {
+		return file
+	}
+	rel, err := filepath.Rel(absBase, absFile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return file
+	}
+	return filepath.ToSlash(rel)
+}
+
+// NewSource reads and parses a template.  Gzipped templates are decompressed
+// transparently, and locations refer to the decompressed text.
+//
+// The file is read exactly once, and the bytes are shared by everything that
+// needs them, which matters for stdin.  We do keep the whole template in
+// memory several times over: the bytes, the lines, the YAML nodes and later
+// the rego input.  Expect a few times the file size in memory use, plus the
+// compressed size for gzipped templates.
 func NewSource(file string) (*Source, error) {
-	bytes, err := ioutil.ReadFile(file)
+	return newSource(file, false, false)
+}
+
+// newSource is like NewSource, but optionally decodes base64 first, e.g. for
+// templates stored as CI artifacts, and replaces template actions, see
+// Options.Templated.
+func newSource(file string, base64 bool, templated bool) (*Source, error) {
+	var data []byte
+	var err error
+	if file == Stdin {
+		file = "<stdin>"
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
 	if err != nil {
-		return nil, err
+		return nil, &ReadError{File: file, Err: err}
+	}
+	if data, err = unwrap(data, base64); err != nil {
+		return nil, &ReadError{File: file, Err: err}
 	}
 
-	var root yaml.Node
-	if err := yaml.Unmarshal(bytes, &root); err != nil {
-		return nil, err
+	source := &Source{
+		file:      file,
+		bytes:     data,
+		lines:     splitLines(data),
+		ends:      map[*yaml.Node][2]int{},
+		synthetic: map[*yaml.Node]bool{},
+	}
+	var placeholders [][2]int
+	if templated {
+		source.bytes, placeholders = stripActions(data)
+	}
+	if err := source.parse(); err != nil {
+		return nil, &ParseError{File: file, Err: err}
+	}
+	if len(placeholders) > 0 {
+		source.markSynthetic(splitLines(source.bytes), placeholders)
+	}
+	for _, root := range source.docs {
+		duplicates := source.removeDuplicates(root, Path{}, []bool{})
+		if len(duplicates) > 0 && isTOML(file) {
+			// Unlike YAML and JSON, TOML doesn't allow this at all.
+			first, last := duplicates[0].keys[0], duplicates[0].keys[1]
+			return nil, &ParseError{File: file, Err: fmt.Errorf("line %d, column %d: key %q already defined at line %d, column %d",
+				last.Line, last.Column, nodeKey(last), first.Line, first.Column)}
+		}
+		source.duplicates = append(source.duplicates, duplicates)
+	}
+	return source, nil
+}
+
+// splitLines splits text into lines.  The `\r` of CRLF line endings is
+// dropped, so positions computed from the lines and the lines we print are
+// the same as for LF.
+func splitLines(data []byte) [][]rune {
+	lines := [][]rune{}
+	for _, line := range strings.Split(string(data), "\n") {
+		lines = append(lines, []rune(strings.TrimSuffix(line, "\r")))
+	}
+	return lines
+}
+
+// parse builds the documents of a source according to its format.
+func (source *Source) parse() error {
+	if isTOML(source.file) {
+		return source.parseTOML()
+	} else if isHCL(source.file) {
+		return source.parseHCL()
 	}
 
-	return &Source{file: file, root: &root}, nil
+	// A single file may hold multiple documents separated by `---`.
+	decoder := yaml.NewDecoder(bytes.NewReader(source.bytes))
+	for {
+		var root yaml.Node
+		if err := decoder.Decode(&root); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		source.skipProperties(&root)
+		source.docs = append(source.docs, &root)
+	}
+}
+
+// decodeError adds the position and path of the node that failed to decode,
+// since yaml.v3 doesn't mention it for e.g. `!!int abc`.
+func decodeError(root *yaml.Node, err error) error {
+	node, path := undecodable(root, Path{})
+	if node == nil {
+		return err
+	} else if len(path) == 0 {
+		return fmt.Errorf("line %d, column %d: %w", node.Line, node.Column, err)
+	}
+	return fmt.Errorf("line %d, column %d at %s: %w", node.Line, node.Column, path, err)
+}
+
+// duplicate is a key that a mapping has more than once.
+type duplicate struct {
+	// The key whose value is ignored and the key that is used instead,
+	// with their values.
+	keys, values [2]*yaml.Node
+	path         Path
+	arrays       []bool
+}
+
+// removeDuplicates drops the keys that a mapping has more than once, except
+// for the last one, and returns the ones it dropped.  yaml.v3 doesn't decode
+// such mappings, while encoding/json keeps the last value, so we do the same
+// for both.  Merge keys are left alone, and so are keys with placeholders,
+// which only look the same, see Options.Templated.
+func (source *Source) removeDuplicates(node *yaml.Node, path Path, arrays []bool) []duplicate {
+	found := []duplicate{}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			found = append(found, source.removeDuplicates(child, path, arrays)...)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			found = append(found, source.removeDuplicates(child,
+				append(path[:len(path):len(path)], strconv.Itoa(i)),
+				append(arrays[:len(arrays):len(arrays)], true))...)
+		}
+	case yaml.MappingNode:
+		compared := func(key *yaml.Node) bool {
+			return key.ShortTag() != "!!merge" && !source.synthetic[key]
+		}
+		last := map[string]int{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if key := node.Content[i]; compared(key) {
+				last[nodeKey(key)] = i
+			}
+		}
+		content := []*yaml.Node{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			child := append(path[:len(path):len(path)], nodeKey(key))
+			childArrays := append(arrays[:len(arrays):len(arrays)], false)
+			if j := last[nodeKey(key)]; compared(key) && j != i {
+				found = append(found, duplicate{
+					keys:   [2]*yaml.Node{key, node.Content[j]},
+					values: [2]*yaml.Node{value, node.Content[j+1]},
+					path:   child,
+					arrays: childArrays,
+				})
+				continue
+			}
+			content = append(content, key, value)
+			found = append(found, source.removeDuplicates(value, child, childArrays)...)
+		}
+		node.Content = content
+	}
+	return found
+}
+
+// undecodable finds the first scalar that can't be decoded.
+func undecodable(node *yaml.Node, path Path) (*yaml.Node, Path) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if n, p := undecodable(child, path); n != nil {
+				return n, p
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if n, p := undecodable(node.Content[i], path); n != nil {
+				return n, p
+			}
+			if n, p := undecodable(node.Content[i+1], append(path, nodeKey(node.Content[i]))); n != nil {
+				return n, p
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			if n, p := undecodable(child, append(path, strconv.Itoa(i))); n != nil {
+				return n, p
+			}
+		}
+	case yaml.ScalarNode:
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return node, path
+		}
+	}
+	return nil, nil
+}
+
+// isEmpty checks if a document has no content, e.g. only comments.
+func isEmpty(doc *yaml.Node) bool {
+	if len(doc.Content) == 0 {
+		return true
+	}
+	root := doc.Content[0]
+	return root.Kind == yaml.ScalarNode && root.ShortTag() == "!!null" && root.Value == ""
 }
 
-func (source *Source) Location(path Path) *Location {
-	cursor := source.root
-	for len(path) > 0 {
+// Location finds the source location of a path in the given document.  It
+// returns nil if the path or the document does not exist in the source.  When the path goes
+// through an alias, the location of the alias is returned rather than the
+// location inside the anchor.
+func (source *Source) Location(doc int, path Path) *Location {
+	site, key, target, arrays := source.resolve(doc, path)
+	if site == nil {
+		return nil
+	}
+	location := source.location(site, target, path, arrays)
+	location.Comment = comment(key)
+	if location.Comment == "" {
+		location.Comment = comment(site)
+	}
+	return location
+}
+
+// AnchorLocation returns the location of the anchored value a path points to
+// when the path goes through an alias, i.e. the place where the value is
+// actually written down.  It returns nil otherwise.
+func (source *Source) AnchorLocation(doc int, path Path) *Location {
+	site, _, target, arrays := source.resolve(doc, path)
+	if site == nil || site == target {
+		return nil
+	}
+	return source.location(target, target, path, arrays)
+}
+
+// Resolve is like Location, but if the path is not found, it returns the
+// location of the longest prefix of the path that does exist, so there is
+// still something to point to.  The boolean reports whether the full path
+// was found.
+func (source *Source) Resolve(doc int, path Path) (*Location, bool) {
+	for n := len(path); n >= 0; n-- {
+		if location := source.Location(doc, path[:n]); location != nil {
+			return location, n == len(path)
+		}
+	}
+	return nil, false
+}
+
+// KeyLocation is like Location, but if the path ends in an object attribute
+// it returns the location of the key instead of the value.  This is useful
+// for rules that check the presence of a key.
+func (source *Source) KeyLocation(doc int, path Path) *Location {
+	site, key, target, arrays := source.resolve(doc, path)
+	if site == nil {
+		return nil
+	} else if key == nil {
+		location := source.location(site, target, path, arrays)
+		location.Comment = comment(site)
+		return location
+	}
+	location := source.location(key, target, path, arrays)
+	location.Key, location.Comment = true, comment(key)
+	return location
+}
+
+// location creates a location pointing to node, with the value of another
+// node, e.g. to point to a key but show its value.
+func (source *Source) location(node *yaml.Node, value *yaml.Node, path Path, arrays []bool) *Location {
+	location := &Location{File: source.file, Path: path, Value: summary(value), arrays: arrays}
+	location.Synthetic = source.synthetic[value]
+	location.Line = node.Line
+	location.Column = node.Column
+	location.EndLine, location.EndColumn = source.end(node)
+	if quoted(node) && (location.EndLine > location.Line || location.EndColumn > location.Column+1) {
+		// Leave out the quotes.
+		location.Column++
+		location.EndColumn--
+	} else if node.Kind == yaml.ScalarNode && (node.Style == yaml.LiteralStyle || node.Style == yaml.FoldedStyle) {
+		// Point to the content rather than the indicator.
+		location.Line, location.Column = source.startBlock(node)
+	}
+	if location.Synthetic && node == value {
+		location.Value = shorten(source.text(location.Line, location.Column, location.EndLine, location.EndColumn))
+	}
+	return location
+}
+
+// comment returns the head comment of a node without the `#`s.  yaml.v3
+// attaches the comment above an attribute to its key.
+func comment(node *yaml.Node) string {
+	if node == nil || node.HeadComment == "" {
+		return ""
+	}
+	lines := strings.Split(node.HeadComment, "\n")
+	for i, line := range lines {
+		line = strings.TrimLeft(strings.TrimSpace(line), "#")
+		lines[i] = strings.TrimPrefix(line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// summary renders a value for display on a single line.  Long scalars are
+// cut off.
+func summary(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) > 0 {
+			return summary(node.Content[0])
+		}
+	case yaml.AliasNode:
+		return "*" + node.Value
+	case yaml.MappingNode:
+		return fmt.Sprintf("{%d keys}", len(node.Content)/2)
+	case yaml.SequenceNode:
+		return fmt.Sprintf("[%d items]", len(node.Content))
+	case yaml.ScalarNode:
+		return shorten(node.Value)
+	}
+	return ""
+}
+
+// shorten cuts off long scalars and escapes newlines.
+func shorten(text string) string {
+	value := []rune(strings.ReplaceAll(text, "\n", "\\n"))
+	if len(value) > 60 {
+		return string(value[:57]) + "..."
+	}
+	return string(value)
+}
+
+// resolve finds the node that should be reported for a path.  If the last
+// step in the path is an object attribute written in this place of the
+// document, the key node is returned as well.  The last node is the value
+// the path points to, which differs from the first one if the path goes
+// through an alias.  The booleans tell which components of the path index an
+// array, see Location.Rego.
+func (source *Source) resolve(doc int, path Path) (*yaml.Node, *yaml.Node, *yaml.Node, []bool) {
+	if doc < 0 || doc >= len(source.docs) {
+		return nil, nil, nil, nil
+	}
+	cursor := source.docs[doc]
+	var site *yaml.Node // Set once we go through an alias.
+	var key *yaml.Node  // Set by the last object attribute before that.
+	arrays := make([]bool, 0, len(path))
+	for cursor != nil && len(path) > 0 {
 		switch cursor.Kind {
-		// Ignore multiple docs in our PoC.
 		case yaml.DocumentNode:
+			if len(cursor.Content) == 0 {
+				return nil, nil, nil, nil
+			}
 			cursor = cursor.Content[0]
+		case yaml.AliasNode:
+			if site == nil {
+				// The rest of the path is written in the anchor,
+				// so the alias is reported rather than a key.
+				site, key = cursor, nil
+			}
+			cursor = cursor.Alias
 		case yaml.MappingNode:
-			// Objects are stored as an array.
-			// Content[2 * n] holds to the key and
-			// Content[2 * n + 1] to the value.
-			for i := 0; i < len(cursor.Content); i += 2 {
-				if cursor.Content[i].Value == path[0] {
-					cursor = cursor.Content[i+1]
-					path = path[1:]
+			k, child, merge := lookup(cursor, path[0])
+			if merge != nil && site == nil {
+				site, key = merge, nil
+			}
+			if site == nil {
+				key = k
+			}
+			cursor, path, arrays = child, path[1:], append(arrays, false)
+		case yaml.SequenceNode:
+			// Array elements are addressed by their index.
+			var child *yaml.Node
+			if i, err := strconv.Atoi(path[0]); err == nil && i >= 0 && i < len(cursor.Content) {
+				child = cursor.Content[i]
+			}
+			cursor, path, key, arrays = child, path[1:], nil, append(arrays, true)
+		default:
+			// We can't descend any further.
+			cursor = nil
+		}
+	}
+	if cursor == nil {
+		return nil, nil, nil, nil
+	} else if site == nil {
+		site = cursor
+	}
+	return site, key, cursor, arrays
+}
+
+// lookup finds the key and value nodes for a key in a mapping node.  Objects
+// are stored as an array: Content[2 * n] holds to the key and
+// Content[2 * n + 1] to the value.  If the key comes from a merge
+// (`<<: *anchor`), the alias it was merged through is returned as well.
+func lookup(mapping *yaml.Node, key string) (*yaml.Node, *yaml.Node, *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		k := mapping.Content[i]
+		if k.ShortTag() != "!!merge" && nodeKey(k) == key {
+			return k, mapping.Content[i+1], nil
+		}
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].ShortTag() != "!!merge" {
+			continue
+		}
+		// Either a single alias or a sequence of them, the first one
+		// takes precedence.
+		merges := []*yaml.Node{mapping.Content[i+1]}
+		if merges[0].Kind == yaml.SequenceNode {
+			merges = merges[0].Content
+		}
+		for _, merge := range merges {
+			target := merge
+			if target.Kind == yaml.AliasNode {
+				target = target.Alias
+			}
+			if target.Kind == yaml.MappingNode {
+				if k, child, _ := lookup(target, key); child != nil {
+					return k, child, merge
 				}
 			}
 		}
 	}
-	return &Location{
-		File:   source.file,
-		Line:   cursor.Line,
-		Column: cursor.Column,
+	return nil, nil, nil
+}
+
+// nodeKey returns the path component for a mapping key.  YAML allows
+// non-string keys such as `80:` or `true:`; these are stringified the same
+// way as in stringKeys, so the paths produced by the policy resolve.
+func nodeKey(key *yaml.Node) string {
+	if key.ShortTag() == "!!str" {
+		return key.Value
+	}
+	var value interface{}
+	if err := key.Decode(&value); err != nil {
+		return key.Value
+	}
+	return fmt.Sprint(value)
+}
+
+// stringKeys converts the maps with non-string keys produced by the YAML
+// decoder into maps with string keys, since rego input objects only use
+// string keys.
+//
+// It also converts the scalars that don't have a JSON equivalent.
+// Timestamps become RFC 3339 strings, like TOML datetimes.  `!!binary`
+// values are decoded to strings, which is what policies want for e.g.
+// embedded scripts, unless the data isn't UTF-8.  That can't be a rego
+// string, so then we keep it base64 encoded.
+func stringKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case string:
+		if !utf8.ValidString(value) {
+			return base64.StdEncoding.EncodeToString([]byte(value))
+		}
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			object[fmt.Sprint(k)] = stringKeys(v)
+		}
+		return object
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = stringKeys(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = stringKeys(v)
+		}
+	}
+	return value
+}
+
+// stringScalars copies a node, tagging all scalars except nulls as strings so
+// they decode the way they are written, see Options.StringValues.  Copies
+// are shared, so aliases still point to their anchor.
+func stringScalars(node *yaml.Node, copies map[*yaml.Node]*yaml.Node) *yaml.Node {
+	if copy, ok := copies[node]; ok {
+		return copy
+	}
+	copy := *node
+	copies[node] = &copy
+	if node.Kind == yaml.ScalarNode && node.ShortTag() != "!!null" && node.ShortTag() != "!!merge" {
+		copy.Tag, copy.Style = "!!str", copy.Style&^yaml.TaggedStyle
+	}
+	copy.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		copy.Content[i] = stringScalars(child, copies)
+	}
+	if node.Alias != nil {
+		copy.Alias = stringScalars(node.Alias, copies)
+	}
+	return &copy
+}
+
+// locations resolves all paths in the tree, and returns the paths that could
+// not be found separately.  If keys is set, object attributes are reported
+// at their key.  If anchors is set, values used through an alias are also
+// reported where they are defined, or only there if only is set as well.
+func (source *Source) locations(doc int, tree PathTree, keys bool, anchors bool, only bool) ([]Location, []Path) {
+	resolve := source.Location
+	if keys {
+		resolve = source.KeyLocation
+	}
+	locations, unresolved := []Location{}, []Path{}
+	for _, path := range tree.List() {
+		if location := resolve(doc, path); location != nil {
+			anchor := source.AnchorLocation(doc, path)
+			if !anchors || !only || anchor == nil {
+				locations = append(locations, *location)
+			}
+			if anchors && anchor != nil {
+				locations = append(locations, *anchor)
+			}
+		} else {
+			unresolved = append(unresolved, path)
+		}
 	}
+	return sortLocations(locations), unresolved
 }
 
+// PathTree is a set of paths, stored as a trie.  Only the longest paths are
+// kept: after inserting `a.b`, `a` is a prefix rather than a path in the
+// tree, and inserting `a` again doesn't change that.
 type PathTree map[string]PathTree
 
 func (tree PathTree) Insert(path Path) {
@@ -82,30 +801,132 @@ func (tree PathTree) Insert(path Path) {
 	}
 }
 
+// Contains checks whether a path is in the tree, either as a path or as a
+// prefix of one.
+func (tree PathTree) Contains(path Path) bool {
+	for _, k := range path {
+		child, ok := tree[k]
+		if !ok {
+			return false
+		}
+		tree = child
+	}
+	return true
+}
+
+// Paths returns the paths in the tree in order, see comparePaths.
+func (tree PathTree) Paths() []Path {
+	paths := tree.List()
+	sort.Slice(paths, func(i, j int) bool { return comparePaths(paths[i], paths[j]) < 0 })
+	return paths
+}
+
+// Prefixes returns the paths in the tree and all their prefixes, in order,
+// e.g. `a`, `a.b` and `a.c` for a tree holding `a.b` and `a.c`.
+func (tree PathTree) Prefixes() []Path {
+	prefixes := []Path{}
+	for _, path := range tree.Paths() {
+		for i := 1; i <= len(path); i++ {
+			prefix := path[:i]
+			if n := len(prefixes); n == 0 || comparePaths(prefixes[n-1], prefix) < 0 {
+				prefixes = append(prefixes, append(Path{}, prefix...))
+			}
+		}
+	}
+	return prefixes
+}
+
+// comparePaths orders paths by their components.  Array indices are
+// compared as numbers, so `items[2]` comes before `items[10]`.  A path comes
+// before the paths it is a prefix of.
+func comparePaths(a, b Path) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, errA := strconv.Atoi(a[i])
+		y, errB := strconv.Atoi(b[i])
+		if errA == nil && errB == nil && x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a[i], b[i])
+	}
+	return len(a) - len(b)
+}
+
+// List returns the paths in the tree, in no particular order.
 func (tree PathTree) List() []Path {
+	out := []Path{}
+	tree.Walk(func(path Path) {
+		out = append(out, append(Path{}, path...))
+	})
+	return out
+}
+
+// Walk calls fn for every path in the tree.  The path shares a buffer with
+// the other calls, so fn must copy it if it wants to hold on to it.  An empty
+// tree has no paths: if the policy didn't use any attributes, there is
+// nothing to point to, not even the whole document.
+func (tree PathTree) Walk(fn func(Path)) {
 	if len(tree) == 0 {
-		// Return the empty path.
-		return []Path{{}}
-	} else {
-		out := []Path{}
-		for k, child := range tree {
-			// Prepend `k` to every child path.
-			for _, childPath := range child.List() {
-				path := Path{k}
-				path = append(path, childPath...)
-				out = append(out, path)
-			}
+		return
+	}
+
+	// We use an explicit stack rather than recursion.  When we pop an entry
+	// at a certain depth, the path buffer still holds its parents, since
+	// only entries pushed after it have been visited.
+	type entry struct {
+		key   string
+		tree  PathTree
+		depth int
+	}
+	stack := []entry{}
+	for k, child := range tree {
+		stack = append(stack, entry{k, child, 1})
+	}
+	path := make(Path, 0, 16)
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		path = append(path[:top.depth-1], top.key)
+		if len(top.tree) == 0 {
+			fn(path)
+			continue
+		}
+		for k, child := range top.tree {
+			stack = append(stack, entry{k, child, top.depth + 1})
 		}
-		return out
 	}
 }
 
+// locationTracer collects the paths of the input used by an evaluation.  It
+// is not safe for concurrent use, Trace updates the tree without locking.
+// Every evaluation should get a fresh tracer, or a tracer that was reset.
 type locationTracer struct {
 	tree PathTree
+	// The annotated input document, if known.  Negated expressions don't
+	// leave the values they looked up in the trace.
+	input *ast.Term
+	// If set, collects the paths that the policy tries to look up,
+	// including the ones that don't exist, see Options.Schema.
+	attempts PathTree
+	// The paths of the terms in the input, by location, see annotate.
+	paths map[*ast.Location]Path
+	// The paths that negated references look up but that don't exist,
+	// see closest.
+	missing PathTree
 }
 
 func newLocationTracer() *locationTracer {
-	return &locationTracer{tree: PathTree{}}
+	return &locationTracer{tree: PathTree{}, paths: map[*ast.Location]Path{}, missing: PathTree{}}
+}
+
+// reset forgets the paths seen so far, so the tracer can be used again.
+func (tracer *locationTracer) reset() {
+	tracer.tree, tracer.missing = PathTree{}, PathTree{}
 }
 
 func (tracer *locationTracer) Enabled() bool {
@@ -119,6 +940,59 @@ func (tracer *locationTracer) Trace(event *topdown.Event) {
 	case topdown.EvalOp:
 		tracer.traceEval(event)
 	}
+	if expr, ok := event.Node.(*ast.Expr); ok && tracer.attempts != nil &&
+		(event.Op == topdown.UnifyOp || event.Op == topdown.EvalOp) {
+		ast.WalkRefs(expr, func(ref ast.Ref) bool {
+			tracer.attempt(event.Plug(ast.NewTerm(ref)).Value)
+			return false
+		})
+	}
+}
+
+// attempt records the path that a reference into the input looks up.
+func (tracer *locationTracer) attempt(value ast.Value) {
+	if path, ok := tracer.lookup(value); ok {
+		tracer.attempts.Insert(path)
+	}
+}
+
+// lookup returns the path that a reference into the input looks up.  The
+// head of the reference is the input or a value from it once the bindings
+// are applied.  We follow the reference for as long as the keys are known.
+func (tracer *locationTracer) lookup(value ast.Value) (Path, bool) {
+	ref, ok := value.(ast.Ref)
+	if !ok {
+		return nil, false
+	}
+	head, keys := ref[0], ref[1:]
+	if head.Equal(ast.InputRootDocument) {
+		if head = tracer.input; head == nil {
+			return nil, false
+		}
+		// Skip the objects around the document, see Options.Wrap.
+		for head.Location == nil && len(keys) > 0 {
+			child := find(head, keys[:1])
+			if child == head {
+				return nil, false
+			}
+			head, keys = child, keys[1:]
+		}
+	}
+	path, ok := tracer.path(head)
+	if !ok {
+		return nil, false
+	}
+	path = append(Path{}, path...)
+	for _, key := range keys {
+		if str, ok := key.Value.(ast.String); ok {
+			path = append(path, string(str))
+		} else if number, ok := key.Value.(ast.Number); ok {
+			path = append(path, number.String())
+		} else {
+			break
+		}
+	}
+	return path, true
 }
 
 func (tracer *locationTracer) traceUnify(event *topdown.Event) {
@@ -126,6 +1000,15 @@ func (tracer *locationTracer) traceUnify(event *topdown.Event) {
 		operands := expr.Operands()
 		if len(operands) == 2 {
 			// Unification (1)
+			for _, operand := range operands {
+				if tracer.input != nil && operand.Value == tracer.input.Value {
+					// The compiler binds the whole input to a
+					// variable when it is passed to a function, as
+					// in `walk(input, x)`.  That doesn't use anything
+					// yet.
+					return
+				}
+			}
 			tracer.used(event.Plug(operands[0]))
 			tracer.used(event.Plug(operands[1]))
 		}
@@ -142,102 +1025,1621 @@ func (tracer *locationTracer) traceEval(event *topdown.Event) {
 				break
 			}
 			operator := terms[0]
-			if _, ok := ast.BuiltinMap[operator.String()]; ok {
+			if operator.String() == ast.Member.Name && len(terms) >= 3 {
+				// Membership, `x in xs`, only uses the matching elements.
+				tracer.member(nil, event.Plug(terms[1]), event.Plug(terms[2]))
+			} else if operator.String() == ast.MemberWithKey.Name && len(terms) >= 4 {
+				// The same for `k, x in xs`.
+				tracer.member(event.Plug(terms[1]), event.Plug(terms[2]), event.Plug(terms[3]))
+			} else if operator.String() == ast.ObjectGet.Name && len(terms) >= 4 {
+				// `object.get` returns a copy of the value it finds, so
+				// we look it up ourselves.
+				tracer.objectGet(event.Plug(terms[1]), event.Plug(terms[2]))
+			} else if operator.String() == ast.WalkBuiltin.Name {
+				// `walk` returns the values of the input as they are,
+				// locations included.  They are used by the expressions
+				// that look at them, not by the walk itself.
+			} else if _, ok := ast.BuiltinMap[operator.String()]; ok {
 				// Built-in function call (2)
 				for _, term := range terms[1:] {
 					tracer.used(event.Plug(term))
 				}
 			}
 		case *ast.Term:
+			if ref, ok := event.Plug(terms).Value.(ast.Ref); ok && expr.Negated {
+				// `not input.x` usually succeeds because input.x is
+				// missing, so we use the closest parent that exists.
+				tracer.closest(ref)
+				break
+			}
 			// Standalone expression (3)
 			tracer.used(event.Plug(terms))
 		}
 	}
 }
 
-func annotate(path Path, term *ast.Term) {
-	// Annotate current term by setting location.
-	if bytes, err := json.Marshal(path); err == nil {
-		term.Location = &ast.Location{}
-		term.Location.File = "path:" + string(bytes)
+// DefaultMaxDepth is the default for Options.MaxDepth.
+const DefaultMaxDepth = 1000
+
+// checkDepth makes sure a document isn't nested more than max levels deep,
+// since annotate and the conversion to rego recurse over it.  It uses an
+// explicit stack itself, like PathTree.Walk.
+func checkDepth(doc interface{}, max int) error {
+	type entry struct {
+		value interface{}
+		depth int
 	}
-	// Recursively annotate children.
-	switch value := term.Value.(type) {
-	case ast.Object:
-		for _, key := range value.Keys() {
-			if str, ok := key.Value.(ast.String); ok {
-				path = append(path, string(str))
-				annotate(path, value.Get(key))
-				path = path[:len(path)-1]
+	stack := []entry{{doc, 0}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.depth > max {
+			return fmt.Errorf("nested deeper than %d levels", max)
+		}
+		switch value := top.value.(type) {
+		case map[string]interface{}:
+			for _, child := range value {
+				stack = append(stack, entry{child, top.depth + 1})
+			}
+		case []interface{}:
+			for _, child := range value {
+				stack = append(stack, entry{child, top.depth + 1})
 			}
 		}
 	}
+	return nil
 }
 
-func (tracer *locationTracer) used(term *ast.Term) {
-	if term.Location != nil {
-		val := strings.TrimPrefix(term.Location.File, "path:")
-		if len(val) != len(term.Location.File) {
-			// Only when we stripped a "path" suffix.
-			var path Path
-			json.Unmarshal([]byte(val), &path)
-			tracer.tree.Insert(path)
+// closest marks the last term found by following a reference into the input
+// for as long as it exists.  The path it was looking for goes in missing if
+// that term isn't the end of it.
+func (tracer *locationTracer) closest(ref ast.Ref) {
+	if tracer.input == nil || !ref[0].Equal(ast.InputRootDocument) {
+		return
+	}
+	term := find(tracer.input, ref[1:])
+	tracer.used(term)
+	if path, ok := tracer.lookup(ref); ok {
+		if found, ok := tracer.path(term); !ok || len(found) < len(path) {
+			tracer.missing.Insert(path)
 		}
 	}
 }
 
-func infer(policy string, file string) error {
-	source, err := NewSource(file)
-	if err != nil {
-		return err
+// objectGet marks the value that `object.get(object, key, default)` finds,
+// or the closest parent that exists if it returns the default.  The key is a
+// path if it is an array.
+func (tracer *locationTracer) objectGet(object *ast.Term, key *ast.Term) {
+	if path, ok := key.Value.(*ast.Array); ok {
+		keys := []*ast.Term{}
+		path.Foreach(func(key *ast.Term) { keys = append(keys, key) })
+		tracer.used(find(object, keys))
+	} else if obj, ok := object.Value.(ast.Object); ok && obj.Get(key) != nil {
+		tracer.used(obj.Get(key))
+	} else {
+		tracer.used(object)
 	}
+}
 
-	bytes, err := ioutil.ReadFile(file)
-	if err != nil {
-		return err
+// find follows keys from a term for as long as they exist, and returns the
+// last term it found.
+func find(term *ast.Term, keys []*ast.Term) *ast.Term {
+	for _, key := range keys {
+		var child *ast.Term
+		switch value := term.Value.(type) {
+		case ast.Object:
+			child = value.Get(key)
+		case *ast.Array:
+			if i, ok := key.Value.(ast.Number); ok {
+				if n, ok := i.Int(); ok && n >= 0 && n < value.Len() {
+					child = value.Elem(n)
+				}
+			}
+		}
+		if child == nil {
+			break
+		}
+		term = child
 	}
+	return term
+}
 
-	var node yaml.Node
-	if err := yaml.Unmarshal(bytes, &node); err != nil {
-		return err
+// member marks the elements of a collection that equal a value, and have the
+// given key if it is not nil, as used.  If there aren't any, the membership
+// check fails, or one of the operands is not known yet; then we fall back to
+// marking the whole collection.
+func (tracer *locationTracer) member(key *ast.Term, value *ast.Term, collection *ast.Term) {
+	found := false
+	match := func(k, v *ast.Term) {
+		if v.Value.Compare(value.Value) == 0 && (key == nil || k.Value.Compare(key.Value) == 0) {
+			tracer.used(v)
+			found = true
+		}
 	}
-
-	var doc interface{}
-	if err := yaml.Unmarshal(bytes, &doc); err != nil {
-		return err
+	switch coll := collection.Value.(type) {
+	case *ast.Array:
+		for i := 0; i < coll.Len(); i++ {
+			match(ast.IntNumberTerm(i), coll.Elem(i))
+		}
+	case ast.Object:
+		coll.Foreach(match)
+	case ast.Set:
+		coll.Foreach(func(v *ast.Term) { match(v, v) })
 	}
-
-	input, err := ast.InterfaceToValue(doc)
-	if err != nil {
-		return err
+	if !found {
+		if key != nil {
+			tracer.used(key)
+		}
+		tracer.used(value)
+		tracer.used(collection)
 	}
+}
 
-	annotate(Path{}, ast.NewTerm(input))
-	if bytes, err = ioutil.ReadFile(policy); err != nil {
-		return err
+func annotate(path Path, term *ast.Term, paths map[*ast.Location]Path) {
+	// Annotate current term by giving it a location of its own.
+	term.Location = &ast.Location{}
+	paths[term.Location] = append(Path{}, path...)
+	// Recursively annotate children.
+	switch value := term.Value.(type) {
+	case ast.Object:
+		for _, key := range value.Keys() {
+			// Non-string keys are stringified, see stringKeys.
+			str, ok := key.Value.(ast.String)
+			if !ok {
+				str = ast.String(key.Value.String())
+			}
+			path = append(path, string(str))
+			annotate(path, value.Get(key), paths)
+			path = path[:len(path)-1]
+		}
+	case *ast.Array:
+		// Array elements use their index as path component.
+		for i := 0; i < value.Len(); i++ {
+			path = append(path, strconv.Itoa(i))
+			annotate(path, value.Elem(i), paths)
+			path = path[:len(path)-1]
+		}
 	}
+}
 
-	tracer := newLocationTracer()
-	results, err := rego.New(
-		rego.Module(policy, string(bytes)),
-		rego.ParsedInput(input),
-		rego.Query("data.policy.deny"),
-		rego.Tracer(tracer),
-	).Eval(context.Background())
-	if err != nil {
-		return err
+// path returns the path that annotate stored for a term, if it has one.
+func (tracer *locationTracer) path(term *ast.Term) (Path, bool) {
+	if term.Location == nil {
+		return nil, false
 	}
+	path, ok := tracer.paths[term.Location]
+	return path, ok
+}
 
-	fmt.Fprintf(os.Stderr, "Results: %v\n", results)
-	for _, path := range tracer.tree.List() {
-		fmt.Fprintf(os.Stderr, "Location: %s\n", source.Location(path).String())
+func (tracer *locationTracer) used(term *ast.Term) {
+	if path, ok := tracer.path(term); ok {
+		tracer.tree.Insert(path)
+		return
+	}
+	// Composite values built in the policy, e.g. the left hand side of
+	// `{"name": input.name} == x`, may contain terms from the input.
+	switch value := term.Value.(type) {
+	case ast.Object:
+		value.Foreach(func(k, v *ast.Term) {
+			tracer.used(k)
+			tracer.used(v)
+		})
+	case *ast.Array:
+		value.Foreach(tracer.used)
+	case ast.Set:
+		value.Foreach(tracer.used)
+	}
+}
+
+// Result is the outcome of running a policy against a single document in a
+// template: the raw rego results, the findings, and the source locations of
+// all attributes that led to a finding.  Attributes that were only looked at
+// by rules that didn't produce anything are not included, see scopedTracer.
+type Result struct {
+	Query string
+	// Severity of the findings, e.g. SeverityWarning for `warn` rules.
+	// Structured findings can override it, see Finding.Severity.
+	Severity string
+	File     string
+	Document int
+	// Results is the result set of the query as rego returned it, with
+	// its expressions and bindings, for callers that need more than the
+	// findings.
+	Results   rego.ResultSet
+	Findings  []Finding
+	Locations []Location
+	// Paths that led to a finding but could not be found in the source.
+	Unresolved []Path
+	// Resource described by the document, for Kubernetes manifests.
+	Resource *Resource
+	// Description is the comment at the top of the document, if it is
+	// separated from the first attribute by a blank line.  Otherwise it
+	// is the Comment of that attribute.
+	Description string
+	// Reads are all the attributes the query looked at, whether they led
+	// to a finding or not.  Only collected with Options.Reads.
+	Reads []Location
+
+	source *Source // Used to show the source text in the output.
+}
+
+// Source returns the template the result was found in, e.g. to quote the
+// lines of its locations with Location.WithContext.
+func (result *Result) Source() *Source {
+	return result.source
+}
+
+// Resource identifies a Kubernetes resource by its `kind` and
+// `metadata.name`.
+type Resource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+}
+
+func (resource Resource) String() string {
+	if resource.Name == "" {
+		return resource.Kind
+	}
+	return resource.Kind + "/" + resource.Name
+}
+
+// resource finds the Kubernetes resource a document describes, if any.  A
+// templated name is shown as it is written, e.g. `{{ .Values.name }}`,
+// rather than as the placeholder we parsed.
+func resource(source *Source, i int, doc interface{}) *Resource {
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	kind, ok := object["kind"].(string)
+	if !ok || kind == "" {
+		return nil
+	}
+	resource := &Resource{Kind: kind}
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		resource.Name, _ = metadata["name"].(string)
+	}
+	if location := source.Location(i, Path{"metadata", "name"}); location != nil && location.Synthetic {
+		resource.Name = location.Value
+	}
+	return resource
+}
+
+// Finding is a single value produced by the query, typically a deny message,
+// together with the locations of the attributes that produced it.
+//
+// Policies may also produce objects such as `{"msg": msg, "severity":
+// "warning"}`.  The message is then taken from the `msg` or `message` field,
+// and the other fields are kept as metadata.
+type Finding struct {
+	Message string
+	// Value is what the rule produced, e.g. the whole object for
+	// structured findings, as it appears in Result.Results.
+	Value interface{}
+	// Severity is the severity of the result, unless the finding is an
+	// object with a valid `severity` field.
+	Severity string
+	// Metadata holds the other fields of structured findings.
+	Metadata   map[string]interface{}
+	Locations  []Location
+	Unresolved []Path
+	// Rules that produced the message, usually just one.
+	Rules []Rule
+}
+
+// Rule is the position of a policy rule in its source file.
+type Rule struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	// Title, Description and Custom come from the `# METADATA` annotations
+	// of the rule, or of the closest scope around it that sets them, see
+	// Options.Annotations.
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Custom      map[string]interface{} `json:"custom,omitempty"`
+}
+
+func (rule Rule) String() string {
+	return fmt.Sprintf("%s at %s:%d", rule.Name, rule.File, rule.Line)
+}
+
+// describe adds the annotations of a rule to it, see Options.Annotations.
+// The chain starts at the rule and goes outwards, so e.g. the title of a rule
+// wins over the title of its package.
+func describe(rule *Rule, chain ast.AnnotationsRefSet) {
+	for _, ref := range chain {
+		annotations := ref.Annotations
+		if annotations == nil {
+			continue
+		}
+		if rule.Title == "" {
+			rule.Title = annotations.Title
+		}
+		if rule.Description == "" {
+			rule.Description = annotations.Description
+		}
+		for k, v := range annotations.Custom {
+			if rule.Custom == nil {
+				rule.Custom = map[string]interface{}{}
+			}
+			if _, ok := rule.Custom[k]; !ok {
+				rule.Custom[k] = v
+			}
+		}
+	}
+}
+
+// Step is a rego expression that read a value, and its position in the
+// policy.
+type Step struct {
+	Expr   string `json:"expr"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+func (step Step) String() string {
+	return fmt.Sprintf("%s:%d: %s", step.File, step.Line, step.Expr)
+}
+
+// DefaultQuery is used when no query is given and the policy doesn't have
+// any rules that are discovered automatically, see DefaultRules.
+const DefaultQuery = "data.policy.deny"
+
+// Severities of findings.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// DefaultRules maps the names of the rules that are evaluated when no query
+// is given to the severity of their findings.  They are found in whatever
+// package they are declared.
+var DefaultRules = map[string]string{
+	"deny":      SeverityError,
+	"violation": SeverityError,
+	"warn":      SeverityWarning,
+	"info":      SeverityInfo,
+}
+
+// Options control how a policy is evaluated.  The zero value uses the
+// defaults.
+type Options struct {
+	// Queries to evaluate, e.g. `data.security.deny` and `data.cost.deny`.
+	// Each query produces its own results.  When empty, all the rules
+	// named in Rules are evaluated.
+	Queries []string
+	// Rules to discover, with their severity, DefaultRules when nil.  This
+	// also determines the severity of a query ending in one of these names.
+	Rules map[string]string
+	// JSON or YAML files or directories to load as data documents, in the
+	// same way as `opa eval --data`.  A `lib.config:config.json` prefix
+	// loads a file under `data.lib.config` rather than at the root.
+	Data []string
+	// Documents are added to data as well, after the files, e.g.
+	// `{"lib": {"config": {"min": 3}}}` for `data.lib.config.min`.
+	Documents map[string]interface{}
+	// Keys reports object attributes at their key rather than their value,
+	// e.g. for rules that check whether a key is present.
+	Keys bool
+	// Anchors also reports values that are used through an alias at the
+	// anchor where they are defined, in addition to the alias.
+	Anchors bool
+	// AnchorsOnly reports values that are used through an alias, e.g. a
+	// `<<: *base` merge key, only at the anchor and not at the alias.
+	AnchorsOnly bool
+	// Root selects the subtree of each document that is used as input,
+	// e.g. Path{"spec", "template"}.  Documents that don't have it are
+	// skipped.
+	Root Path
+	// Relative reports paths relative to Root rather than to the document.
+	Relative bool
+	// Wrap nests each document, or its Root, under these keys in the
+	// input, for policies that expect e.g. `input.resource.spec` rather
+	// than `input.spec`.  Reported paths don't include them.
+	Wrap Path
+	// Document only checks the document with this index in templates with
+	// multiple documents, counting from 0 like Result.Document.  All
+	// documents are checked when it is nil.
+	Document *int
+	// Base64 decodes templates before parsing them.
+	Base64 bool
+	// Base, if set, is the directory that files in locations and results
+	// are relative to, e.g. the root of a repository.  They use forward
+	// slashes then, also on Windows.  Files outside it are left alone.
+	Base string
+	// Templated replaces Go template and Jinja expressions, such as
+	// `{{ .Values.image }}` in a Helm chart, by placeholders before parsing,
+	// see stripActions.  Findings that depend on a placeholder are dropped,
+	// since the actual values aren't known.
+	Templated bool
+	// Reads collects every attribute the policy looks at in Result.Reads,
+	// e.g. to see which parts of a template a policy covers.
+	Reads bool
+	// NoEval doesn't evaluate the policy at all.  Instead, every document
+	// gets a Result for StaticQuery without findings, whose Reads are the
+	// attributes the policy refers to literally, like
+	// `input.spec.replicas`.  References that depend on variables, like
+	// `input.items[i].name`, only count up to the variable.
+	NoEval bool
+	// StringValues decodes every scalar except null as the string it is
+	// written as, e.g. `"8080"` for `port: 8080` and `"0x1F"` for `0x1F`,
+	// for policies that don't expect typed values.
+	StringValues bool
+	// Wasm evaluates the queries with OPA's WebAssembly engine, which is
+	// only available in builds with `-tags opa_wasm`.  That evaluation
+	// can't be traced, so it only finds the results: each finding is still
+	// attributed by the regular evaluator, which also handles Reads and
+	// Schema.  This pays off when most documents pass.  For policies that
+	// are already compiled, see WasmBundle.  Inputs that JSON can't
+	// represent, like `.inf`, don't match anything.
+	Wasm bool
+	// WasmBundle loads a bundle built with `opa build -t wasm`, a directory
+	// or a .tar.gz file, in addition to the policies.  Its rego is compiled
+	// with them, but rego evaluates the entrypoints of its WebAssembly
+	// modules with the module instead, which takes a build with `-tags
+	// opa_wasm`.  That can't be traced, so findings of a query that an
+	// entrypoint answers are located at the whole document.  Other queries
+	// are traced as usual.
+	WasmBundle string
+	// Annotations parses the `# METADATA` annotations of the policies and
+	// adds their title, description and custom fields to Finding.Rules.  A
+	// `severity` custom field overrides the severity of the query, and is
+	// itself overridden by the severity of a structured finding.  Modules
+	// passed to NewScannerFromModules need to be parsed with
+	// ast.ParserOptions.ProcessAnnotation for this.
+	Annotations bool
+	// Explain lists the rego expressions that read each location of a
+	// finding in Location.Explanation, outermost first.  An expression
+	// that calls a function or rule comes before the expressions in its
+	// body.
+	Explain bool
+	// Ignore suppresses known findings, see LoadIgnores.
+	Ignore []Ignore
+	// Schema, if set, is used to report attributes that the policy reads but
+	// that the schema doesn't define, usually typos, as warnings in a Result
+	// for SchemaQuery.  See LoadSchema.
+	Schema Schema
+	// MaxDepth limits how deeply documents may be nested, templates that
+	// exceed it fail with a ParseError.  DefaultMaxDepth when zero.
+	MaxDepth int
+	// Logger receives debug output, such as the input, the raw results and
+	// the full evaluation trace.  Nothing is logged when it is nil.
+	Logger *log.Logger
+}
+
+// mergeDocuments adds documents to data.  Objects are merged, but other
+// values can't be overridden.
+func mergeDocuments(data map[string]interface{}, documents map[string]interface{}) error {
+	for k, v := range documents {
+		existing, ok := data[k]
+		if !ok {
+			data[k] = v
+			continue
+		}
+		a, okA := existing.(map[string]interface{})
+		b, okB := v.(map[string]interface{})
+		if !okA || !okB {
+			return fmt.Errorf("data document %s is defined twice", k)
+		}
+		if err := mergeDocuments(a, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// values returns the values produced by a query.  If the query produces a
+// set, e.g. a set of deny messages, we return the elements.  A boolean rule,
+// e.g. `deny { ... }`, only produces a value when it is true.
+func values(resultSet rego.ResultSet) []interface{} {
+	out := []interface{}{}
+	for _, r := range resultSet {
+		for _, expr := range r.Expressions {
+			if elems, ok := expr.Value.([]interface{}); ok {
+				out = append(out, elems...)
+			} else if expr.Value != false {
+				out = append(out, expr.Value)
+			}
+		}
+	}
+	return out
+}
+
+// structured splits an object produced by a query into its message and the
+// other fields.  Values without a message field are rendered as a whole.
+func structured(value interface{}) (string, map[string]interface{}) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return message(value), nil
+	}
+	for _, field := range []string{"msg", "message"} {
+		if msg, ok := object[field]; ok {
+			metadata := map[string]interface{}{}
+			for k, v := range object {
+				if k != field {
+					metadata[k] = v
+				}
+			}
+			return message(msg), metadata
+		}
+	}
+	return message(value), nil
+}
+
+// isSeverity checks whether a string is one of the severities.
+func isSeverity(severity string) bool {
+	return severity == SeverityError || severity == SeverityWarning || severity == SeverityInfo
+}
+
+// message renders a value as message.  Non-string values are rendered as
+// JSON.
+func message(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	} else if bytes, err := json.Marshal(value); err == nil {
+		return string(bytes)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// errorDetail points to the column of a compile error in the offending line
+// of the policy, the same way rego parse errors do.
+func errorDetail(text []byte, location *ast.Location) ast.ErrorDetails {
+	lines := strings.Split(string(text), "\n")
+	if location.Row < 1 || location.Row > len(lines) {
+		return nil
+	}
+	return &ast.ParserErrorDetail{Line: lines[location.Row-1], Idx: location.Col - 1}
+}
+
+// Scanner holds a compiled policy, so it can be evaluated against many
+// templates without parsing and compiling it again.
+type Scanner struct {
+	queries  []preparedQuery
+	compiler *ast.Compiler
+	store    storage.Store
+	keys     bool
+	anchors  bool
+	// Where to report values used through an alias, see Options.AnchorsOnly.
+	anchorsOnly bool
+	root        Path
+	relative    bool
+	wrap        Path
+	document    *int
+	base64      bool
+	base        string
+	// See Options.Templated.
+	templated    bool
+	stringValues bool
+	reads        bool
+	noEval       bool
+	schema       Schema
+	// The paths the policy reads directly from input, see inputRefs.
+	inputRefs []Path
+	explain   bool
+	// See Options.Annotations.
+	annotations bool
+	ignore      []Ignore
+	maxDepth    int
+	logger      *log.Logger
+}
+
+type preparedQuery struct {
+	query    string
+	severity string
+	prepared rego.PreparedEvalQuery
+	// The same query compiled to WebAssembly, see Options.Wasm.
+	wasm *rego.PreparedEvalQuery
+	// Whether a module of Options.WasmBundle answers the query, which
+	// means it can't be traced.
+	resolved bool
+}
+
+// discover finds the queries for all the given rules, e.g.
+// `data.foo.bar.deny` for a deny rule in `package foo.bar`.  WebAssembly
+// bundles don't contain their rego, so their entrypoints count as rules too.
+func discover(modules map[string]*ast.Module, entrypoints []ast.Ref, rules map[string]string) []string {
+	found := map[string]bool{}
+	for _, module := range modules {
+		for _, rule := range module.Rules {
+			ref := rule.Head.Ref()
+			if len(ref) != 1 {
+				continue
+			}
+			if name, ok := ref[0].Value.(ast.Var); ok && rules[string(name)] != "" {
+				found[module.Package.Path.String()+"."+string(name)] = true
+			}
+		}
+	}
+	for _, entrypoint := range entrypoints {
+		name, ok := entrypoint[len(entrypoint)-1].Value.(ast.String)
+		if ok && len(entrypoint) > 1 && rules[string(name)] != "" {
+			found[entrypoint.String()] = true
+		}
+	}
+	queries := []string{}
+	for query := range found {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+	return queries
+}
+
+// severity finds the severity for a query based on the name of the rule it
+// refers to.  Anything else is considered an error.
+func severity(query string, rules map[string]string) string {
+	name := query[strings.LastIndex(query, ".")+1:]
+	if severity, ok := rules[name]; ok {
+		return severity
+	}
+	return SeverityError
+}
+
+// NewScanner loads the given rego files.  Directories are searched for rego
+// files recursively, skipping tests.
+func NewScanner(policies []string, options Options) (*Scanner, error) {
+	modules := map[string]*ast.Module{}
+	texts := map[string][]byte{}
+	for _, policy := range policies {
+		err := filepath.WalkDir(policy, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return &ReadError{File: file, Err: err}
+			} else if entry.IsDir() {
+				return nil
+			}
+			// Files given explicitly are always loaded.
+			if file != policy && (filepath.Ext(file) != ".rego" ||
+				strings.HasSuffix(file, "_test.rego")) {
+				return nil
+			}
+			bytes, err := os.ReadFile(file)
+			if err != nil {
+				return &ReadError{File: file, Err: err}
+			}
+			module, err := ast.ParseModuleWithOpts(file, string(bytes), ast.ParserOptions{
+				ProcessAnnotation: options.Annotations,
+			})
+			if err != nil {
+				return &ParseError{File: file, Err: err}
+			}
+			modules[file] = module
+			texts[file] = bytes
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newScanner(modules, texts, options)
+}
+
+// NewScannerFromModules is like NewScanner, for applications that load and
+// parse policies themselves, e.g. from a database.  The modules are keyed by
+// file name, as for ast.Compiler.  They are compiled together, and must not
+// be modified afterwards.
+func NewScannerFromModules(modules map[string]*ast.Module, options Options) (*Scanner, error) {
+	return newScanner(modules, nil, options)
+}
+
+// newScanner compiles the modules.  The texts of the files, if known, are
+// quoted in compile errors.
+func newScanner(modules map[string]*ast.Module, texts map[string][]byte, options Options) (*Scanner, error) {
+	compiler := ast.NewCompiler()
+	if compiler.Compile(modules); compiler.Failed() {
+		for _, e := range compiler.Errors {
+			if e.Details == nil && e.Location != nil && texts[e.Location.File] != nil {
+				e.Details = errorDetail(texts[e.Location.File], e.Location)
+			}
+		}
+		err := &CompileError{Err: compiler.Errors}
+		if location := compiler.Errors[0].Location; location != nil {
+			err.File = location.File
+		}
+		return nil, err
+	}
+
+	// Load data documents, ignoring any policies in there.
+	data, err := loader.NewFileLoader().Filtered(
+		options.Data,
+		func(_ string, info fs.FileInfo, _ int) bool {
+			return !info.IsDir() && filepath.Ext(info.Name()) == ".rego"
+		},
+	)
+	if err != nil {
+		// The loader mentions the file in its errors.
+		return nil, &ReadError{Err: err}
+	}
+	documents := data.Documents
+	if err := mergeDocuments(documents, options.Documents); err != nil {
+		return nil, err
+	}
+	store := inmem.NewFromObject(documents)
+
+	entrypoints := []ast.Ref{}
+	if options.WasmBundle != "" {
+		// Activating the bundle compiles its rego together with the
+		// modules, and puts its WebAssembly modules in the store, where
+		// rego finds them as resolvers for their entrypoints.
+		ctx := context.Background()
+		txn, err := store.NewTransaction(ctx, storage.WriteParams)
+		if err != nil {
+			return nil, &ReadError{File: options.WasmBundle, Err: err}
+		}
+		activate := []func(*rego.Rego){
+			rego.Compiler(compiler),
+			rego.Store(store),
+			rego.Transaction(txn),
+			rego.LoadBundle(options.WasmBundle),
+			rego.Query("true"),
+		}
+		for _, module := range modules {
+			activate = append(activate, rego.ParsedModule(module))
+		}
+		if _, err := rego.New(activate...).PrepareForEval(ctx); err != nil {
+			store.Abort(ctx, txn)
+			if !wasmEngine {
+				err = fmt.Errorf("%w (WebAssembly modules need a build with -tags opa_wasm)", err)
+			}
+			return nil, &CompileError{File: options.WasmBundle, Err: err}
+		} else if err := store.Commit(ctx, txn); err != nil {
+			return nil, &CompileError{File: options.WasmBundle, Err: err}
+		}
+		if entrypoints, err = wasmEntrypoints(store); err != nil {
+			return nil, &ReadError{File: options.WasmBundle, Err: err}
+		}
+		modules = compiler.Modules
+	}
+
+	rules := options.Rules
+	if rules == nil {
+		rules = DefaultRules
+	}
+	queries := options.Queries
+	if len(queries) == 0 {
+		if queries = discover(modules, entrypoints, rules); len(queries) == 0 {
+			queries = []string{DefaultQuery}
+		}
+	}
+	if options.Wasm && !wasmEngine {
+		return nil, &CompileError{Err: errors.New("WebAssembly evaluation needs a build with -tags opa_wasm")}
+	}
+	prepared := []preparedQuery{}
+	for _, query := range queries {
+		p, err := rego.New(
+			rego.Compiler(compiler),
+			rego.Store(store),
+			rego.Query(query),
+		).PrepareForEval(context.Background())
+		if err != nil {
+			// E.g. the query refers to something that doesn't exist.
+			return nil, &CompileError{Err: err}
+		}
+		q := preparedQuery{
+			query:    query,
+			severity: severity(query, rules),
+			prepared: p,
+		}
+		if ref, err := ast.ParseRef(query); err == nil {
+			for _, entrypoint := range entrypoints {
+				q.resolved = q.resolved || ref.HasPrefix(entrypoint)
+			}
+		}
+		if options.Wasm {
+			w, err := rego.New(
+				rego.Compiler(compiler),
+				rego.Store(store),
+				rego.Query(query),
+				rego.Target("wasm"),
+			).PrepareForEval(context.Background())
+			if err != nil {
+				// E.g. a built-in function the engine doesn't have.
+				return nil, &CompileError{Err: err}
+			}
+			q.wasm = &w
+		}
+		prepared = append(prepared, q)
+	}
+
+	maxDepth := options.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	return &Scanner{
+		queries:      prepared,
+		compiler:     compiler,
+		store:        store,
+		keys:         options.Keys,
+		anchors:      options.Anchors || options.AnchorsOnly,
+		anchorsOnly:  options.AnchorsOnly,
+		root:         options.Root,
+		relative:     options.Relative,
+		document:     options.Document,
+		base64:       options.Base64,
+		base:         options.Base,
+		templated:    options.Templated,
+		stringValues: options.StringValues,
+		reads:        options.Reads,
+		noEval:       options.NoEval,
+		schema:       options.Schema,
+		wrap:         options.Wrap,
+		inputRefs:    inputRefs(compiler.Modules, options.Wrap),
+		explain:      options.Explain,
+		annotations:  options.Annotations,
+		ignore:       options.Ignore,
+		maxDepth:     maxDepth,
+		logger:       options.Logger,
+	}, nil
+}
+
+// wasmEntrypoints returns the entrypoints of the WebAssembly modules of the
+// bundles in a store, e.g. `data.policy.deny`.
+func wasmEntrypoints(store storage.Store) ([]ast.Ref, error) {
+	ctx := context.Background()
+	txn, err := store.NewTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Abort(ctx, txn)
+	names, err := bundle.ReadBundleNamesFromStore(ctx, store, txn)
+	if err != nil && !storage.IsNotFound(err) {
+		return nil, err
+	}
+	entrypoints := []ast.Ref{}
+	for _, name := range names {
+		resolvers, err := bundle.ReadWasmMetadataFromStore(ctx, store, txn, name)
+		if err != nil && !storage.IsNotFound(err) {
+			return nil, err
+		}
+		for _, resolver := range resolvers {
+			ref, err := ast.PtrRef(ast.DefaultRootDocument, resolver.Entrypoint)
+			if err != nil {
+				return nil, err
+			}
+			entrypoints = append(entrypoints, ref)
+		}
+	}
+	return entrypoints, nil
+}
+
+// Scan evaluates the policy against every document in a template.
+func (scanner *Scanner) Scan(ctx context.Context, file string) ([]*Result, error) {
+	source, err := newSource(file, scanner.base64, scanner.templated)
+	if err != nil {
+		return nil, err
+	}
+	if scanner.base != "" && file != Stdin {
+		source.file = relativeFile(scanner.base, source.file)
+	}
+
+	// Don't read the file again, it may be stdin.
+	data := source.bytes
+
+	empty := true
+	for _, root := range source.docs {
+		empty = empty && isEmpty(root)
+	}
+	if empty {
+		return nil, &ParseError{File: source.file, Err: errors.New("empty document")}
+	}
+	if n := scanner.document; n != nil && (*n < 0 || *n >= len(source.docs)) {
+		return nil, &ParseError{
+			File: source.file,
+			Err:  fmt.Errorf("there is no document %d, the template has %d", *n, len(source.docs)),
+		}
+	}
+
+	var docs []interface{}
+	if extension(file) == ".json" && !scanner.stringValues {
+		// JSON is valid YAML, so the source locations work out the same.
+		// However, we decode the input as JSON to stick to its semantics,
+		// e.g. for large numbers.
+		var doc interface{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, &ParseError{File: source.file, Err: err}
+		}
+		docs = append(docs, doc)
+	} else {
+		// This includes TOML and HCL, which we convert to YAML nodes.
+		for i, root := range source.docs {
+			var doc interface{}
+			if !scanner.selected(i) {
+				// Don't fail on documents we were asked to skip.
+				docs = append(docs, nil)
+				continue
+			}
+			node := root
+			if scanner.stringValues {
+				node = stringScalars(root, map[*yaml.Node]*yaml.Node{})
+			}
+			if err := node.Decode(&doc); err != nil {
+				return nil, &ParseError{File: source.file, Err: decodeError(root, err)}
+			}
+			docs = append(docs, stringKeys(doc))
+		}
 	}
+
+	results := []*Result{}
+	for i, doc := range docs {
+		if !scanner.selected(i) {
+			continue
+		} else if isEmpty(source.docs[i]) {
+			// E.g. a trailing `---`, we keep counting so the document
+			// numbers match the file.
+			continue
+		}
+
+		if err := checkDepth(doc, scanner.maxDepth); err != nil {
+			return nil, &ParseError{File: source.file, Err: fmt.Errorf("document %d: %w", i, err)}
+		}
+		resource, description := resource(source, i, doc), comment(source.docs[i])
+		doc, ok := subtree(doc, scanner.root)
+		if !ok {
+			continue
+		}
+
+		value, err := ast.InterfaceToValue(doc)
+		if err != nil {
+			return nil, &ParseError{File: source.file, Err: err}
+		}
+
+		// Paths are annotated from the root of the document, so they can
+		// be resolved in the source.
+		input := ast.NewTerm(value)
+		paths := map[*ast.Location]Path{}
+		annotate(append(Path{}, scanner.root...), input, paths)
+		input = wrap(input, scanner.wrap)
+		if scanner.logger != nil {
+			scanner.logger.Printf("Input (%s, document %d): %v", source.file, i, input)
+		}
+		var attempts PathTree
+		if scanner.schema != nil {
+			attempts = PathTree{}
+			for _, path := range scanner.inputRefs {
+				attempts.Insert(append(append(Path{}, scanner.root...), path...))
+			}
+		}
+		for _, query := range scanner.queries {
+			if scanner.noEval {
+				break
+			}
+			result, err := scanner.evaluate(ctx, query, source, i, input, paths, attempts)
+			if err != nil {
+				return nil, err
+			}
+			result.Resource, result.Description = resource, description
+			results = append(results, result)
+		}
+		if scanner.noEval {
+			result := scanner.static(source, i)
+			result.Resource, result.Description = resource, description
+			results = append(results, result)
+		}
+		if scanner.schema != nil {
+			result := scanner.unknownFindings(source, i, attempts)
+			result.Resource, result.Description = resource, description
+			results = append(results, result)
+		}
+		if len(source.duplicates[i]) > 0 {
+			result := scanner.duplicateFindings(source, i)
+			result.Resource, result.Description = resource, description
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// selected checks whether a document should be checked, see
+// Options.Document.
+func (scanner *Scanner) selected(doc int) bool {
+	return scanner.document == nil || *scanner.document == doc
+}
+
+// evaluate runs a single query against a document.  If attempts isn't nil,
+// the paths that the query tries to read are added to it.
+func (scanner *Scanner) evaluate(
+	ctx context.Context,
+	query preparedQuery,
+	source *Source,
+	doc int,
+	input *ast.Term,
+	paths map[*ast.Location]Path,
+	attempts PathTree,
+) (*Result, error) {
+	evalOptions := []rego.EvalOption{rego.EvalParsedInput(input.Value)}
+	trace := topdown.NewBufferTracer()
+	if scanner.logger != nil {
+		evalOptions = append(evalOptions, rego.EvalQueryTracer(trace))
+	}
+	reads := newLocationTracer()
+	reads.input, reads.paths, reads.attempts = input, paths, attempts
+	if scanner.reads || attempts != nil {
+		evalOptions = append(evalOptions, rego.EvalTracer(reads))
+	}
+	if scanner.reads {
+		// The rule index skips rules whose conditions on the input don't
+		// match without evaluating them, so we wouldn't see those reads.
+		evalOptions = append(evalOptions, rego.EvalRuleIndexing(false))
+	}
+	prepared := query.prepared
+	if query.wasm != nil && !scanner.reads && attempts == nil && scanner.logger == nil {
+		// There is nothing to trace, see Options.Wasm.
+		prepared = *query.wasm
+	}
+	resultSet, err := prepared.Eval(ctx, evalOptions...)
+	if err != nil {
+		return nil, evalError(ctx, source.file, err)
+	}
+	if scanner.logger != nil {
+		scanner.logger.Printf("Results (%s, document %d, %s): %v", source.file, doc, query.query, resultSet)
+		scanner.logger.Printf("Trace (%s, document %d, %s):", source.file, doc, query.query)
+		topdown.PrettyTrace(scanner.logger.Writer(), *trace)
+	}
+
+	result := &Result{
+		Query:    query.query,
+		Severity: query.severity,
+		File:     source.file,
+		Document: doc,
+		Results:  resultSet,
+		source:   source,
+	}
+	if scanner.reads {
+		result.Reads, _ = scanner.locations(source, doc, reads.tree)
+	}
+	// Only attributes that led to a finding are reported, not all the
+	// attributes the policy looked at.
+	result.Locations, result.Unresolved = []Location{}, []Path{}
+	unresolved := map[string]bool{}
+	for _, value := range values(resultSet) {
+		finding, err := scanner.finding(ctx, query, source, doc, input, paths, value)
+		if err != nil {
+			return nil, err
+		} else if !applyIgnores(scanner.ignore, query.query, finding) || synthetic(finding) {
+			continue
+		}
+		finding.Severity = query.severity
+		for _, rule := range finding.Rules {
+			if severity, ok := rule.Custom["severity"].(string); ok && isSeverity(severity) {
+				finding.Severity = severity
+				break
+			}
+		}
+		if severity, ok := finding.Metadata["severity"].(string); ok && isSeverity(severity) {
+			finding.Severity = severity
+		}
+		result.Findings = append(result.Findings, *finding)
+		result.Locations = append(result.Locations, finding.Locations...)
+		for _, path := range finding.Unresolved {
+			if !unresolved[path.Pointer()] {
+				unresolved[path.Pointer()] = true
+				result.Unresolved = append(result.Unresolved, path)
+			}
+		}
+	}
+	result.Locations = sortLocations(result.Locations)
+	return result, nil
+}
+
+// StaticQuery is the query of the Results of Options.NoEval.
+const StaticQuery = "static"
+
+// static resolves the references to the input in the policy, without
+// evaluating it, see Options.NoEval.
+func (scanner *Scanner) static(source *Source, doc int) *Result {
+	tree := PathTree{}
+	for _, path := range scanner.inputRefs {
+		tree.Insert(append(append(Path{}, scanner.root...), path...))
+	}
+	result := &Result{
+		Query:     StaticQuery,
+		File:      source.file,
+		Document:  doc,
+		Locations: []Location{},
+		source:    source,
+	}
+	result.Reads, result.Unresolved = scanner.locations(source, doc, tree)
+	return result
+}
+
+// DuplicateQuery is the query of the Result that reports keys that a mapping
+// has more than once.  Only the last value is used, which is usually not
+// what the author meant.
+const DuplicateQuery = "duplicate"
+
+// duplicateFindings warns about the keys that a mapping in a document has
+// more than once, at both keys.
+func (scanner *Scanner) duplicateFindings(source *Source, doc int) *Result {
+	result := &Result{
+		Query:      DuplicateQuery,
+		Severity:   SeverityWarning,
+		File:       source.file,
+		Document:   doc,
+		Locations:  []Location{},
+		Unresolved: []Path{},
+		source:     source,
+	}
+	for _, duplicate := range source.duplicates[doc] {
+		root := len(scanner.root)
+		if len(duplicate.path) < root || comparePaths(duplicate.path[:root], scanner.root) != 0 {
+			// Only the document under Options.Root is checked.
+			continue
+		}
+		finding := Finding{Severity: SeverityWarning}
+		for i, key := range duplicate.keys {
+			location := source.location(key, duplicate.values[i], duplicate.path, duplicate.arrays)
+			location.Key = true
+			if scanner.relative {
+				location.Path = location.Path[len(scanner.root):]
+				location.arrays = location.arrays[len(scanner.root):]
+			}
+			finding.Locations = append(finding.Locations, *location)
+		}
+		finding.Message = fmt.Sprintf("key %q at %s is defined again at %s, which replaces its value",
+			nodeKey(duplicate.keys[1]), finding.Locations[0], finding.Locations[1])
+		result.Findings = append(result.Findings, finding)
+		result.Locations = append(result.Locations, finding.Locations...)
+	}
+	result.Locations = sortLocations(result.Locations)
+	return result
+}
+
+// wrap nests the input under keys, see Options.Wrap.  The objects around it
+// have no location, so they are never reported themselves.
+func wrap(input *ast.Term, keys Path) *ast.Term {
+	for i := len(keys) - 1; i >= 0; i-- {
+		input = ast.ObjectTerm(ast.Item(ast.StringTerm(keys[i]), input))
+	}
+	return input
+}
+
+// subtree selects the value at a path in a decoded document.
+func subtree(doc interface{}, path Path) (interface{}, bool) {
+	for _, component := range path {
+		switch value := doc.(type) {
+		case map[string]interface{}:
+			child, ok := value[component]
+			if !ok {
+				return nil, false
+			}
+			doc = child
+		case []interface{}:
+			i, err := strconv.Atoi(component)
+			if err != nil || i < 0 || i >= len(value) {
+				return nil, false
+			}
+			doc = value[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// locations resolves the paths used by the policy in the source, and makes
+// them relative to the root of the input if requested.
+func (scanner *Scanner) locations(source *Source, doc int, tree PathTree) ([]Location, []Path) {
+	locations, unresolved := source.locations(doc, tree, scanner.keys, scanner.anchors, scanner.anchorsOnly)
+	if scanner.relative {
+		for i := range locations {
+			locations[i].Path = locations[i].Path[len(scanner.root):]
+			locations[i].arrays = locations[i].arrays[len(scanner.root):]
+		}
+		for i := range unresolved {
+			unresolved[i] = unresolved[i][len(scanner.root):]
+		}
+	}
+	return locations, unresolved
+}
+
+// evalError wraps an evaluation error.  If the evaluation was cancelled, the
+// error of the context is used, so callers can check for
+// context.DeadlineExceeded.
+func evalError(ctx context.Context, file string, err error) error {
+	if topdown.IsCancel(err) && ctx.Err() != nil {
+		err = fmt.Errorf("policy evaluation stopped: %w", ctx.Err())
+	}
+	return &EvalError{File: file, Err: err}
+}
+
+// finding figures out which attributes produced a specific result.  If the
+// query is a reference, e.g. `data.policy.deny`, we evaluate
+// `data.policy.deny[result]` using a scopedTracer, so we only see the
+// evaluations that produce that result.  Otherwise, we fall back to all
+// successful evaluations of the query.
+func (scanner *Scanner) finding(
+	ctx context.Context,
+	prepared preparedQuery,
+	source *Source,
+	doc int,
+	input *ast.Term,
+	paths map[*ast.Location]Path,
+	result interface{},
+) (*Finding, error) {
+	finding := &Finding{Value: result}
+	finding.Message, finding.Metadata = structured(result)
+	value, err := ast.InterfaceToValue(result)
+	if err != nil {
+		return nil, &EvalError{File: source.file, Err: err}
+	}
+
+	text := prepared.query
+	if prepared.resolved {
+		// A WebAssembly module produced the result, so there is nothing
+		// to trace, see Options.WasmBundle.
+		finding.Locations = []Location{}
+		if location := source.Location(doc, scanner.root); location != nil {
+			if scanner.relative {
+				location.Path, location.arrays = Path{}, []bool{}
+			}
+			finding.Locations = append(finding.Locations, *location)
+		}
+		if result == true {
+			finding.Message = text
+		}
+		return finding, nil
+	}
+
+	query := ast.MustParseBody(text)
+	if result == true {
+		// A boolean rule, there is nothing to look up: the bodies that
+		// made it true are the ones that exist.  "true" isn't much of a
+		// message, so we use the query.
+		finding.Message = text
+	} else if term, ok := query[0].Terms.(*ast.Term); len(query) == 1 && ok {
+		if ref, ok := term.Value.(ast.Ref); ok && ref.IsGround() {
+			query = ast.NewBody(ast.NewExpr(ast.NewTerm(ref.Append(ast.NewTerm(value)))))
+		}
+	}
+
+	tracer := newScopedTracer(input, paths)
+	if _, err := rego.New(
+		rego.Compiler(scanner.compiler),
+		rego.Store(scanner.store),
+		rego.ParsedQuery(query),
+		rego.ParsedInput(input.Value),
+		rego.Tracer(tracer),
+	).Eval(ctx); err != nil {
+		return nil, evalError(ctx, source.file, err)
+	}
+	finding.Locations, finding.Unresolved = scanner.locations(source, doc, tracer.tree)
+	// The parents of missing attributes are in the tree, we only list the
+	// attributes themselves.
+	_, missing := scanner.locations(source, doc, tracer.missing)
+	finding.Unresolved = append(finding.Unresolved, missing...)
+	finding.Rules = tracer.rules
+	if scanner.annotations {
+		for i, rule := range tracer.nodes {
+			describe(&finding.Rules[i], scanner.compiler.GetAnnotationSet().Chain(rule))
+		}
+	}
+	for i, location := range finding.Locations {
+		if scanner.explain {
+			path := location.Path
+			if scanner.relative {
+				path = append(append(Path{}, scanner.root...), path...)
+			}
+			finding.Locations[i].Explanation = tracer.explain(path)
+		}
+	}
+	if scanner.logger != nil {
+		scanner.logger.Printf("Paths (%s): %v", finding.Message, tracer.tree.Paths())
+	}
+	return finding, nil
+}
+
+// ScanDir evaluates the policy against every template in a directory tree.
+// Only files with a name matching the glob pattern are checked, or all YAML,
+// JSON, TOML and HCL files if the pattern is empty.
+func (scanner *Scanner) ScanDir(ctx context.Context, dir string, pattern string) ([]*Result, error) {
+	files := []string{}
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return &ReadError{File: file, Err: err}
+		} else if entry.IsDir() {
+			return nil
+		}
+		if ok, err := isTemplate(entry.Name(), pattern); err != nil || !ok {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Templates are independent, so we scan them in parallel.  Each Scan
+	// uses its own tracers, and the rest of the scanner is only read.  The
+	// debug output would be interleaved, so then we use a single worker.
+	workers := runtime.GOMAXPROCS(0)
+	if scanner.logger != nil {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fileResults := make([][]*Result, len(files))
+	errs := make([]error, len(files))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if errs[i] = ctx.Err(); errs[i] != nil {
+					continue
+				}
+				if fileResults[i], errs[i] = scanner.Scan(ctx, files[i]); errs[i] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Keep the order of the walk, and report the first error in that order
+	// that isn't just the result of cancelling the others.
+	results := []*Result{}
+	var cancelled error
+	for i := range files {
+		if errs[i] != nil && ctx.Err() != nil && errors.Is(errs[i], context.Canceled) {
+			cancelled = errs[i]
+		} else if errs[i] != nil {
+			return nil, errs[i]
+		}
+		results = append(results, fileResults[i]...)
+	}
+	if cancelled != nil {
+		return nil, cancelled
+	}
+	return results, nil
+}
+
+func isTemplate(name string, pattern string) (bool, error) {
+	if pattern != "" {
+		return filepath.Match(pattern, name)
+	}
+	switch extension(name) {
+	case ".yml", ".yaml", ".json", ".toml", ".tf", ".hcl":
+		return true, nil
+	}
+	return false, nil
+}
+
+// Infer evaluates a policy against a single template.  Use a Scanner when
+// checking many templates against the same policy.
+func Infer(ctx context.Context, policy string, file string, options Options) ([]*Result, error) {
+	scanner, err := NewScanner([]string{policy}, options)
+	if err != nil {
+		return nil, err
+	}
+	return scanner.Scan(ctx, file)
+}
+
+// listFlag is a flag that can be given multiple times.
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, value)
 	return nil
 }
 
 func main() {
-	if err := infer("policy.rego", "template.yml"); err != nil {
+	policies := listFlag{}
+	flag.Var(&policies, "policy", "rego policy file or directory to evaluate, may be repeated (default \"policy.rego\")")
+	input := flag.String("input", "template.yml", "YAML, JSON, TOML or HCL template or directory to check, - for stdin")
+	baseline := flag.String("baseline", "", "template to compare the input with, e.g. from the target branch, to only report findings it doesn't have")
+	glob := flag.String("glob", "", "only check files matching this pattern in a directory, e.g. *.yaml")
+	data := listFlag{}
+	flag.Var(&data, "data", "JSON or YAML data file or directory to load, may be repeated, prefix with lib.config: to load it under data.lib.config")
+	queries := listFlag{}
+	flag.Var(&queries, "query", "rego query to evaluate, may be repeated (default every deny, warn and violation rule)")
+	format := flag.String("format", FormatText, "output format: text, annotated, json, sarif or github")
+	color := flag.String("color", ColorAuto, "when to color text and annotated output: auto (terminals without NO_COLOR), always or never")
+	keys := flag.Bool("keys", false, "report object attributes at their key rather than their value")
+	exitZero := flag.Bool("exit-zero", false, "exit with status 0 even if the policy denies something")
+	root := flag.String("root", "", "only use this subtree of each document as input, e.g. spec.template")
+	relative := flag.Bool("relative", false, "report paths relative to -root")
+	wrapper := flag.String("wrap", "", "nest each document under these keys in the input, e.g. resource for policies reading input.resource.spec")
+	base := flag.String("base", ".", "report files relative to this directory, empty to report them as given")
+	document := flag.Int("doc", -1, "only check the document with this index in multi-document templates, counting from 0")
+	anchors := flag.Bool("anchors", false, "also report values used through an alias where the anchor defines them")
+	anchorsOnly := flag.Bool("anchors-only", false, "report values used through an alias only where the anchor defines them")
+	decode := flag.Bool("base64", false, "decode templates as base64 before parsing them")
+	templated := flag.Bool("templated", false, "replace {{ ... }} template expressions, e.g. in Helm charts, before parsing")
+	debug := flag.Bool("debug", false, "log the input, raw results and evaluation trace to stderr")
+	reads := flag.Bool("reads", false, "list every attribute the policy reads instead of the findings, text and json only")
+	noEval := flag.Bool("no-eval", false, "list the attributes the policy refers to without evaluating it, like -reads but only literal references")
+	stringValues := flag.Bool("string-values", false, "decode every scalar but null as the string it is written as, for policies that don't expect numbers or booleans")
+	wasm := flag.Bool("wasm", false, "evaluate the queries with OPA's WebAssembly engine, in builds with -tags opa_wasm")
+	wasmBundle := flag.String("wasm-bundle", "", "bundle built with opa build -t wasm to evaluate as well, in builds with -tags opa_wasm; its entrypoints are reported at the whole document")
+	annotations := flag.Bool("annotations", false, "show the titles and descriptions of rules from their METADATA annotations")
+	explain := flag.Bool("explain", false, "show the rego expressions that read each reported attribute")
+	schema := flag.String("schema", "", "JSON Schema of the templates, to warn about attributes the policy reads that it doesn't define")
+	ignore := flag.String("ignore", "", "YAML or JSON file listing the rule and path of findings to suppress")
+	maxDepth := flag.Int("max-depth", DefaultMaxDepth, "reject templates nested deeper than this")
+	maxLocations := flag.Int("max", 0, "only report the first this many locations of findings (default all)")
+	timeout := flag.Duration("timeout", 0, "stop evaluating the policy after this long, e.g. 30s (default no timeout)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nExits with status 1 if there are findings with severity error, and 2 on\nerrors.\n")
+	}
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format != FormatText && *format != FormatJSON && *format != FormatSARIF &&
+		*format != FormatAnnotated && *format != FormatGitHub {
+		fmt.Fprintf(os.Stderr, "unknown format: %s\n\n", *format)
+		flag.Usage()
+		os.Exit(2)
+	} else if *color != ColorAuto && *color != ColorAlways && *color != ColorNever {
+		fmt.Fprintf(os.Stderr, "unknown color mode: %s\n\n", *color)
+		flag.Usage()
+		os.Exit(2)
+	} else if (*reads || *noEval) && *format != FormatText && *format != FormatJSON {
+		fmt.Fprintf(os.Stderr, "-reads and -no-eval only support the text and json formats\n\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(policies) == 0 && *wasmBundle == "" {
+		policies = append(policies, "policy.rego")
+	}
+	files := append([]string{*input}, policies...)
+	if *wasmBundle != "" {
+		files = append(files, *wasmBundle)
+	}
+	if *baseline != "" {
+		if info, _ := os.Stat(*input); info != nil && info.IsDir() {
+			fmt.Fprintf(os.Stderr, "-baseline only supports a single template as input\n\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+		files = append(files, *baseline)
+	}
+	for _, file := range data {
+		_, file = loader.SplitPrefix(file)
+		files = append(files, file)
+	}
+	for _, file := range files {
+		if file == Stdin {
+			continue
+		} else if _, err := os.Stat(file); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n\n", err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	options := Options{
+		Queries:      queries,
+		Data:         data,
+		Keys:         *keys,
+		Anchors:      *anchors,
+		AnchorsOnly:  *anchorsOnly,
+		Relative:     *relative,
+		Base64:       *decode,
+		Base:         *base,
+		Templated:    *templated,
+		StringValues: *stringValues,
+		Reads:        *reads,
+		NoEval:       *noEval,
+		Wasm:         *wasm,
+		WasmBundle:   *wasmBundle,
+		Explain:      *explain,
+		Annotations:  *annotations,
+		MaxDepth:     *maxDepth,
+	}
+	if *debug {
+		options.Logger = log.New(os.Stderr, "", 0)
+	}
+	if *root != "" {
+		options.Root = strings.Split(*root, ".")
+	}
+	if *wrapper != "" {
+		options.Wrap = strings.Split(*wrapper, ".")
+	}
+	if *document >= 0 {
+		options.Document = document
+	}
+	if *schema != "" {
+		var err error
+		if options.Schema, err = LoadSchema(*schema); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(2)
+		}
+	}
+	if *ignore != "" {
+		var err error
+		if options.Ignore, err = LoadIgnores(*ignore); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(2)
+		}
+	}
+	scanner, err := NewScanner(policies, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	var results []*Result
+	if info, _ := os.Stat(*input); info != nil && info.IsDir() {
+		results, err = scanner.ScanDir(ctx, *input, *glob)
+	} else {
+		results, err = scanner.Scan(ctx, *input)
+	}
+	if err == nil && *baseline != "" {
+		var base []*Result
+		if base, err = scanner.Scan(ctx, *baseline); err == nil {
+			results = NewFindings(results, base)
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "policy evaluation timed out after %s\n", *timeout)
+		os.Exit(2)
+	} else if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(1)
+		os.Exit(2)
+	}
+
+	output, omitted := results, 0
+	if *maxLocations > 0 {
+		output, omitted = limit(results, *maxLocations)
+	}
+	switch {
+	case (*reads || *noEval) && *format == FormatJSON:
+		err = writeReadsJSON(os.Stdout, output)
+	case *reads || *noEval:
+		err = writeReads(os.Stderr, output, newPalette(*color, os.Stderr))
+	case *format == FormatJSON:
+		err = writeJSON(os.Stdout, output)
+	case *format == FormatSARIF:
+		err = writeSARIF(os.Stdout, output)
+	case *format == FormatGitHub:
+		err = writeGitHub(os.Stdout, output)
+	case *format == FormatAnnotated:
+		err = writeAnnotated(os.Stderr, output, newPalette(*color, os.Stderr))
+	default:
+		err = writeText(os.Stderr, output, newPalette(*color, os.Stderr))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	} else if omitted == 1 {
+		fmt.Fprintf(os.Stderr, "…and 1 more location\n")
+	} else if omitted > 1 {
+		fmt.Fprintf(os.Stderr, "…and %d more locations\n", omitted)
+	}
+
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			// Warnings and info don't fail the run, and neither does -reads.
+			if finding.Severity == SeverityError && !*exitZero && !*reads {
+				os.Exit(1)
+			}
+		}
 	}
 }
@@ -0,0 +1,2714 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// TestGolden runs Infer over every directory in testdata/golden, and compares
+// the JSON and annotated output with its golden.json and annotated.txt.  A
+// directory holds a policy.rego, a single template.* in any of the supported
+// formats, and optionally an options.json with the Options to use, e.g.
+// `{"Keys": true}`.
+func TestGolden(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "golden", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			templates, err := filepath.Glob(filepath.Join(dir, "template.*"))
+			if err != nil {
+				t.Fatal(err)
+			} else if len(templates) != 1 {
+				t.Fatalf("expected a single template in %s, found %d", dir, len(templates))
+			}
+			options := Options{}
+			if data, err := os.ReadFile(filepath.Join(dir, "options.json")); err == nil {
+				if err := json.Unmarshal(data, &options); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Report files relative to the fixture, so the golden files
+			// don't depend on where they are.
+			options.Base = dir
+
+			// Forward slashes keep the rule files the same on Windows.
+			policy := filepath.ToSlash(filepath.Join(dir, "policy.rego"))
+			results, err := Infer(context.Background(), policy, templates[0], options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var output bytes.Buffer
+			if err := writeJSON(&output, results); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, filepath.Join(dir, "golden.json"), output.Bytes())
+			output.Reset()
+			if err := writeAnnotated(&output, results, palette{}); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, filepath.Join(dir, "annotated.txt"), output.Bytes())
+		})
+	}
+}
+
+// golden compares output with a golden file, or rewrites it with -update.
+func golden(t *testing.T, file string, output []byte) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(file, output, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%s, run go test -update to create it", err)
+	}
+	if !bytes.Equal(output, expected) {
+		t.Errorf("output differs from %s, run go test -update if that is expected:\n%s", file, output)
+	}
+}
+
+// writeFile creates a file for a test.
+func writeFile(t *testing.T, file string, text string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSource parses a template given as text.
+func testSource(t *testing.T, name string, text string) *Source {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	writeFile(t, file, text)
+	source, err := NewSource(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+// scan runs a policy against a template, both given as text.  The name of
+// the template determines its format.  Files are reported relative to the
+// directory they are written to.
+func scan(t *testing.T, policy string, name string, template string, options Options) ([]*Result, error) {
+	t.Helper()
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "policy.rego"), policy)
+	writeFile(t, filepath.Join(dir, name), template)
+	if options.Base == "" {
+		options.Base = dir
+	}
+	return Infer(context.Background(), filepath.Join(dir, "policy.rego"), filepath.Join(dir, name), options)
+}
+
+// infer runs a policy against a template, both given as text, and returns the
+// locations of each finding by message, as `path@line:column`, followed by
+// the paths that don't resolve as `path@?`.
+func infer(t *testing.T, policy string, name string, template string, options Options) map[string][]string {
+	t.Helper()
+	results, err := scan(t, policy, name, template, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings := map[string][]string{}
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			locations := []string{}
+			for _, location := range finding.Locations {
+				locations = append(locations, fmt.Sprintf("%s@%d:%d", location.Path, location.Line, location.Column))
+			}
+			for _, path := range finding.Unresolved {
+				locations = append(locations, path.String()+"@?")
+			}
+			findings[finding.Message] = locations
+		}
+	}
+	return findings
+}
+
+// position renders the start of a location, without the file.
+func position(location *Location) string {
+	if location == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%d:%d", location.Line, location.Column)
+}
+
+// positions renders locations as `line:column`, in the order of the source.
+func positions(locations []Location) []string {
+	sorted := append([]Location{}, locations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Line != sorted[j].Line {
+			return sorted[i].Line < sorted[j].Line
+		}
+		return sorted[i].Column < sorted[j].Column
+	})
+	found := []string{}
+	for _, location := range sorted {
+		found = append(found, fmt.Sprintf("%d:%d", location.Line, location.Column))
+	}
+	return found
+}
+
+func TestInfer(t *testing.T) {
+	second := 1
+	for _, test := range []struct {
+		name     string
+		policy   string
+		template string
+		options  Options
+		expected map[string][]string
+	}{
+		{
+			// Lists of maps, with the index in the path.
+			name: "sequences",
+			policy: `package policy
+
+deny[msg] {
+	rule := input.Resources[name].Properties.SecurityGroupIngress[_]
+	rule.CidrIp == "0.0.0.0/0"
+	msg := sprintf("%s is open to the world", [name])
+}
+`,
+			template: `Resources:
+  Group:
+    Properties:
+      SecurityGroupIngress:
+      - CidrIp: 10.0.0.0/8
+        FromPort: 22
+      - CidrIp: 0.0.0.0/0
+        FromPort: 22
+`,
+			expected: map[string][]string{
+				"Group is open to the world": {"Resources.Group.Properties.SecurityGroupIngress[1].CidrIp@7:17"},
+			},
+		},
+		{
+			// Each message only gets the attributes of its own rule.
+			name: "messages",
+			policy: `package policy
+
+deny[msg] {
+	input.replicas < 2
+	msg := "not enough replicas"
+}
+
+deny[msg] {
+	input.image == "latest"
+	msg := "image is not pinned"
+}
+`,
+			template: "replicas: 1\nimage: latest\n",
+			expected: map[string][]string{
+				"not enough replicas": {"replicas@1:11"},
+				"image is not pinned": {"image@2:8"},
+			},
+		},
+		{
+			// Attributes read by a rule that doesn't deny anything are
+			// not reported.
+			name: "scoped",
+			policy: `package policy
+
+deny[msg] {
+	input.foo == "bar"
+	msg := "foo is bar"
+}
+
+deny[msg] {
+	input.replicas < 2
+	msg := "not enough replicas"
+}
+`,
+			template: "foo: baz\nreplicas: 1\n",
+			expected: map[string][]string{
+				"not enough replicas": {"replicas@2:11"},
+			},
+		},
+		{
+			// A missing attribute is reported at its closest parent, and listed
+			// as unresolved.
+			name: "not",
+			policy: `package policy
+
+deny[msg] {
+	not input.bucket.encryption
+	msg := "bucket is not encrypted"
+}
+`,
+			template: "bucket:\n  name: logs\n",
+			expected: map[string][]string{
+				"bucket is not encrypted": {"bucket@2:3", "bucket.encryption@?"},
+			},
+		},
+		{
+			// Keys that aren't strings are stringified, like in rego.
+			name: "integer keys",
+			policy: `package policy
+
+deny[msg] {
+	input.ports["80"] == "http"
+	msg := "plain http"
+}
+`,
+			template: "ports:\n  80: http\n  443: https\n",
+			expected: map[string][]string{
+				"plain http": {"ports[80]@2:7"},
+			},
+		},
+		{
+			// Comparing objects uses all of their attributes.
+			name: "object equality",
+			policy: `package policy
+
+deny[msg] {
+	input.spec.resources == {"cpu": "1", "memory": "1Gi"}
+	msg := "default resources"
+}
+`,
+			template: "spec:\n  resources:\n    cpu: \"1\"\n    memory: 1Gi\n",
+			expected: map[string][]string{
+				"default resources": {"spec.resources.cpu@3:11", "spec.resources.memory@4:13"},
+			},
+		},
+		{
+			// Attributes nested in an object built by the policy.
+			name: "composite operand",
+			policy: `package policy
+
+deny[msg] {
+	{"name": input.metadata.name, "port": input.spec.port} == {"name": "web", "port": 80}
+	msg := "plain http"
+}
+`,
+			template: "metadata:\n  name: web\nspec:\n  port: 80\n  replicas: 1\n",
+			expected: map[string][]string{
+				"plain http": {"metadata.name@2:9", "spec.port@4:9"},
+			},
+		},
+		{
+			// Elements of flow collections have their own columns.
+			name: "flow style",
+			policy: `package policy
+
+deny[msg] {
+	input.spec.ports[_] == 8080
+	input.spec.selector.app == "web"
+	msg := "flow"
+}
+`,
+			template: "spec: {ports: [80, 8080, \"9090\"], selector: {app: web}}\n",
+			expected: map[string][]string{
+				"flow": {"spec.ports[1]@1:20", "spec.selector.app@1:51"},
+			},
+		},
+		{
+			// Every element of a flow sequence has its own column.
+			name: "flow sequence",
+			policy: `package policy
+
+deny[msg] {
+	port := input.ports[_]
+	port > 0
+	msg := sprintf("port %d", [port])
+}
+`,
+			template: "ports: [80, 443, 8080]\n",
+			expected: map[string][]string{
+				"port 80":   {"ports[0]@1:9"},
+				"port 443":  {"ports[1]@1:13"},
+				"port 8080": {"ports[2]@1:18"},
+			},
+		},
+		{
+			name: "root",
+			policy: `package policy
+
+deny[msg] {
+	input.replicas < 2
+	msg := "replicas"
+}
+`,
+			template: "spec:\n  template:\n    replicas: 1\n",
+			options:  Options{Root: Path{"spec", "template"}, Relative: true},
+			expected: map[string][]string{
+				"replicas": {"replicas@3:15"},
+			},
+		},
+		{
+			// Without Relative, the paths start at the document.
+			name: "absolute root",
+			policy: `package policy
+
+deny[msg] {
+	input.replicas < 2
+	msg := "replicas"
+}
+`,
+			template: "spec:\n  template:\n    replicas: 1\n---\nkind: Other\n",
+			options:  Options{Root: Path{"spec", "template"}},
+			expected: map[string][]string{
+				"replicas": {"spec.template.replicas@3:15"},
+			},
+		},
+		{
+			// Wrapping keys are not part of the paths.
+			name: "wrap",
+			policy: `package policy
+
+deny[msg] {
+	input.resource.spec.replicas < 2
+	msg := "replicas"
+}
+`,
+			template: "spec:\n  replicas: 1\n",
+			options:  Options{Wrap: Path{"resource"}},
+			expected: map[string][]string{
+				"replicas": {"spec.replicas@2:13"},
+			},
+		},
+		{
+			// The same template as below, with typed scalars.
+			name: "typed values",
+			policy: `package policy
+
+deny[msg] {
+	input.port == "8080"
+	input.version == "1.10"
+	msg := "strings"
+}
+
+deny[msg] {
+	input.port == 8080
+	input.version == 1.1
+	msg := "numbers"
+}
+`,
+			template: "port: 8080\nversion: 1.10\n",
+			expected: map[string][]string{
+				"numbers": {"port@1:7", "version@2:10"},
+			},
+		},
+		{
+			name: "string values",
+			policy: `package policy
+
+deny[msg] {
+	input.port == "8080"
+	input.version == "1.10"
+	msg := "strings"
+}
+
+deny[msg] {
+	input.port == 8080
+	input.version == 1.1
+	msg := "numbers"
+}
+`,
+			template: "port: 8080\nversion: 1.10\n",
+			options:  Options{StringValues: true},
+			expected: map[string][]string{
+				"strings": {"port@1:7", "version@2:10"},
+			},
+		},
+		{
+			// `!!float 1` is still a number, located at the value after the tag.
+			name: "float tag",
+			policy: `package policy
+
+deny[msg] {
+	is_number(input.ratio)
+	input.ratio == 1
+	msg := "number"
+}
+`,
+			template: "ratio: !!float 1\n",
+			expected: map[string][]string{
+				"number": {"ratio@1:16"},
+			},
+		},
+		{
+			// Quotes keep a number a string.
+			name: "quoted number",
+			policy: `package policy
+
+deny[msg] {
+	is_string(input.id)
+	input.id == "123"
+	msg := "string"
+}
+
+deny[msg] {
+	input.id == 123
+	msg := "number"
+}
+`,
+			template: "id: \"123\"\n",
+			expected: map[string][]string{
+				"string": {"id@1:6"},
+			},
+		},
+		{
+			name: "comprehension",
+			policy: `package policy
+
+deny[msg] {
+	privileged := [c.name | c := input.containers[_]; c.privileged]
+	count(privileged) > 0
+	msg := "privileged containers"
+}
+`,
+			template: `containers:
+- name: app
+  privileged: false
+- name: sidecar
+  privileged: true
+`,
+			expected: map[string][]string{
+				"privileged containers": {"containers[1].name@4:9", "containers[1].privileged@5:15"},
+			},
+		},
+		{
+			name: "some",
+			policy: `package policy
+
+deny[msg] {
+	some i
+	input.items[i].size > 10
+	msg := sprintf("item %d is too large", [i])
+}
+`,
+			template: "items:\n- size: 1\n- size: 20\n",
+			expected: map[string][]string{
+				"item 1 is too large": {"items[1].size@3:9"},
+			},
+		},
+		{
+			// Columns count characters rather than bytes.
+			name: "unicode",
+			policy: `package policy
+
+deny[msg] {
+	input["名前"] == "ウェブ"
+	msg := "bad name"
+}
+
+deny[msg] {
+	input.emoji == "😀"
+	msg := "emoji"
+}
+`,
+			template: "名前: ウェブ\nemoji: \"😀\"\n",
+			expected: map[string][]string{
+				"bad name": {`["名前"]@1:5`},
+				"emoji":    {"emoji@2:9"},
+			},
+		},
+		{
+			// Paths through sequences resolve by index, also when a whole
+			// element is matched by value.
+			name: "element",
+			policy: `package policy
+
+deny[msg] {
+	container := input.spec.containers[_]
+	container == {"name": "app", "image": "nginx"}
+	msg := sprintf("%s runs nginx", [container.name])
+}
+`,
+			template: `spec:
+  containers:
+  - name: sidecar
+    image: envoy
+  - name: app
+    image: nginx
+`,
+			expected: map[string][]string{
+				"app runs nginx": {"spec.containers[1].name@5:11", "spec.containers[1].image@6:12"},
+			},
+		},
+		{
+			// Membership only uses the elements that match.
+			name: "membership",
+			policy: `package policy
+
+import future.keywords.in
+
+deny[msg] {
+	"prod" in input.tags
+	input.tags[_] == "public"
+	msg := "public production"
+}
+`,
+			template: "tags: [dev, prod, public]\n",
+			expected: map[string][]string{
+				"public production": {"tags[1]@1:13", "tags[2]@1:19"},
+			},
+		},
+		{
+			// Lists at the top level, like some Kubernetes manifests.
+			name: "root list",
+			policy: `package policy
+
+deny[msg] {
+	input[0].x == 1
+	msg := "first x"
+}
+`,
+			template: `- x: 1
+- x: 2
+`,
+			expected: map[string][]string{
+				"first x": {"[0].x@1:6"},
+			},
+		},
+		{
+			// Queries can point to rules deep in a package hierarchy.
+			name: "namespaced",
+			policy: `package org.team.kubernetes.checks
+
+violation[msg] {
+	input.replicas < data.org.limits.replicas
+	msg := "too few replicas"
+}
+`,
+			template: "replicas: 1\n",
+			options: Options{
+				Queries:   []string{"data.org.team.kubernetes.checks.violation"},
+				Documents: map[string]interface{}{"org": map[string]interface{}{"limits": map[string]interface{}{"replicas": 2}}},
+			},
+			expected: map[string][]string{
+				"too few replicas": {"replicas@1:11"},
+			},
+		},
+		{
+			// The keys that index input may come from data.
+			name: "data",
+			policy: `package policy
+
+deny[msg] {
+	name := data.required[_]
+	not input.labels[name]
+	msg := sprintf("missing label %s", [name])
+}
+`,
+			template: "labels:\n  app: web\n",
+			options: Options{Documents: map[string]interface{}{
+				"required": []interface{}{"app", "team"},
+			}},
+			expected: map[string][]string{
+				"missing label team": {"labels@2:3", "labels.team@?"},
+			},
+		},
+		{
+			// Keys that come from data are plugged in.
+			name: "data key",
+			policy: `package policy
+
+deny[msg] {
+	input.labels[data.owner_label] == ""
+	msg := "no owner"
+}
+
+deny[msg] {
+	key := data.checked[_]
+	input.spec[key] < 2
+	msg := sprintf("%s too low", [key])
+}
+`,
+			template: "labels:\n  app: web\n  team: \"\"\nspec:\n  replicas: 1\n  workers: 4\n",
+			options: Options{Documents: map[string]interface{}{
+				"owner_label": "team",
+				"checked":     []interface{}{"replicas", "workers"},
+			}},
+			expected: map[string][]string{
+				"no owner":         {"labels.team@3:10"},
+				"replicas too low": {"spec.replicas@5:13"},
+			},
+		},
+		{
+			// A boolean rule gives a single finding, named after the
+			// query.
+			name: "boolean",
+			policy: `package policy
+
+deny {
+	input.replicas < 2
+}
+`,
+			template: "name: web\nreplicas: 1\n",
+			expected: map[string][]string{
+				"data.policy.deny": {"replicas@2:11"},
+			},
+		},
+		{
+			// And none when it is false.
+			name: "boolean pass",
+			policy: `package policy
+
+default deny = false
+
+deny {
+	input.replicas < 2
+}
+`,
+			template: "name: web\nreplicas: 3\n",
+			expected: map[string][]string{},
+		},
+		{
+			// Template expressions become placeholders, and findings that
+			// depend on them are dropped.
+			name: "templated",
+			policy: `package policy
+
+deny[msg] {
+	input.image == "latest"
+	msg := "image"
+}
+
+deny[msg] {
+	input.replicas < 2
+	msg := "replicas"
+}
+`,
+			template: "image: {{ .Values.image }}\nreplicas: 1\n",
+			options:  Options{Templated: true},
+			expected: map[string][]string{
+				"replicas": {"replicas@2:11"},
+			},
+		},
+		{
+			// Attributes the template doesn't have are still reported,
+			// without a position.
+			name: "missing attribute",
+			policy: `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	not input.spec.strategy.type
+	msg := "replicas"
+}
+`,
+			template: "spec:\n  replicas: 1\n",
+			expected: map[string][]string{
+				"replicas": {"spec.replicas@2:13", "spec.strategy.type@?"},
+			},
+		},
+		{
+			// Merged values are reported at the merge key by default.
+			name: "merge key",
+			policy: `package policy
+
+deny[msg] {
+	input.web.port < 1024
+	msg := "privileged port"
+}
+`,
+			template: "defaults: &defaults\n  port: 80\nweb:\n  <<: *defaults\n",
+			expected: map[string][]string{
+				"privileged port": {"web.port@4:7"},
+			},
+		},
+		{
+			// Merged values are only reported where the anchor defines
+			// them.
+			name: "anchors only",
+			policy: `package policy
+
+deny[msg] {
+	input.web.port < 1024
+	msg := "privileged port"
+}
+`,
+			template: "defaults: &defaults\n  port: 80\nweb:\n  <<: *defaults\n",
+			options:  Options{AnchorsOnly: true},
+			expected: map[string][]string{
+				"privileged port": {"web.port@2:9"},
+			},
+		},
+		{
+			// Timestamps become RFC 3339 strings, binary values are
+			// decoded.
+			name: "tags",
+			policy: `package policy
+
+deny[msg] {
+	startswith(input.created, "2024-01-02T")
+	contains(input.script, "curl")
+	msg := "tags"
+}
+`,
+			template: "created: 2024-01-02 03:04:05\nscript: !!binary Y3VybCBleGFtcGxlLmNvbQ==\n",
+			expected: map[string][]string{
+				"tags": {"created@1:10", "script@2:18"},
+			},
+		},
+		{
+			// Only the document given by Options.Document is checked.
+			name: "document",
+			policy: `package policy
+
+deny[msg] {
+	msg := input.name
+}
+`,
+			template: "name: a\n---\nname: b\n---\nname: c\n",
+			options:  Options{Document: &second},
+			expected: map[string][]string{
+				"b": {"name@3:7"},
+			},
+		},
+		{
+			name: "walk",
+			policy: `package policy
+
+deny[msg] {
+	walk(input, [path, value])
+	path[count(path) - 1] == "privileged"
+	value == true
+	msg := "privileged"
+}
+`,
+			template: "spec:\n  security:\n    privileged: true\n  name: app\n",
+			expected: map[string][]string{
+				"privileged": {"spec.security.privileged@3:17"},
+			},
+		},
+		{
+			// When object.get returns the default, the closest parent is
+			// reported.
+			name: "object.get",
+			policy: `package policy
+
+deny[msg] {
+	object.get(input, ["spec", "security", "privileged"], false)
+	msg := "privileged"
+}
+
+deny[msg] {
+	not object.get(input.spec, "replicas", 1) > 1
+	msg := "not enough replicas"
+}
+`,
+			template: "spec:\n  security:\n    privileged: true\n  name: app\n",
+			expected: map[string][]string{
+				"privileged":          {"spec.security.privileged@3:17"},
+				"not enough replicas": {"spec@2:3"},
+			},
+		},
+		{
+			// Values used through an alias are reported at the alias,
+			// and with Anchors also where the anchor defines them.
+			name: "anchors",
+			policy: `package policy
+
+deny[msg] {
+	input[name].port < 1024
+	msg := sprintf("%s uses a privileged port", [name])
+}
+`,
+			template: `defaults: &defaults
+  port: 80
+web:
+  <<: *defaults
+  name: web
+api: *defaults
+`,
+			options: Options{Anchors: true},
+			expected: map[string][]string{
+				"defaults uses a privileged port": {"defaults.port@2:9"},
+				"web uses a privileged port":      {"web.port@2:9", "web.port@4:7"},
+				"api uses a privileged port":      {"api.port@2:9", "api.port@6:6"},
+			},
+		},
+		{
+			// A rule that doesn't read the input has no locations.
+			name: "no attributes",
+			policy: `package policy
+
+deny[msg] {
+	msg := "always"
+}
+`,
+			template: "name: web\n",
+			expected: map[string][]string{
+				"always": {},
+			},
+		},
+	} {
+		found := infer(t, test.policy, "template.yml", test.template, test.options)
+		if !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, found, test.expected)
+		}
+	}
+}
+
+// TestScalarTags checks that scalars get the type of their YAML tag, whether
+// it is resolved or explicit, while quoted scalars stay strings.
+func TestScalarTags(t *testing.T) {
+	findings := infer(t, `package policy
+
+deny[msg] {
+	some key
+	msg := sprintf("%s %s", [key, type_name(input[key])])
+}
+`, "template.yml", `int: 80
+float: 0.5
+explicit float: !!float 1
+bool: true
+none: ~
+quoted: "123"
+explicit str: !!str 123
+`, Options{})
+	found := []string{}
+	for message := range findings {
+		found = append(found, message)
+	}
+	sort.Strings(found)
+	expected := []string{
+		"bool boolean",
+		"explicit float number",
+		"explicit str string",
+		"float number",
+		"int number",
+		"none null",
+		"quoted string",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+}
+
+// TestLocation checks that a path finds its own node when keys and values
+// repeat, e.g. a list element that looks like the next index.
+func TestLocation(t *testing.T) {
+	source := testSource(t, "template.yml", `ports:
+  - 80
+  - 443
+  - 1
+  - 8080
+name: web
+spec:
+  name: web
+  labels: {name: web}
+  app: web
+`)
+	for _, test := range []struct {
+		path     Path
+		expected string
+	}{
+		{Path{"ports"}, "2:3"},
+		{Path{"ports", "1"}, "3:5"},
+		{Path{"ports", "2"}, "4:5"},
+		{Path{"name"}, "6:7"},
+		{Path{"spec"}, "8:3"},
+		{Path{"spec", "name"}, "8:9"},
+		{Path{"spec", "labels", "name"}, "9:18"},
+		{Path{"spec", "app"}, "10:8"},
+		// Paths that don't exist in the source have no location.
+		{Path{"spec", "replicas"}, "<nil>"},
+		{Path{"ports", "4"}, "<nil>"},
+		{Path{"name", "first"}, "<nil>"},
+	} {
+		if found := position(source.Location(0, test.path)); found != test.expected {
+			t.Errorf("Location(%v) = %s, expected %s", test.path, found, test.expected)
+		}
+	}
+}
+
+func TestKeyLocation(t *testing.T) {
+	source := testSource(t, "template.yml", `base: &base
+  port: 80
+svc:
+  <<: *base
+  name: web
+other: *base
+flow: {name: web, replicas: 3}
+`)
+	for _, test := range []struct {
+		path     Path
+		position string
+		key      bool
+	}{
+		{Path{"svc", "name"}, "5:3", true},
+		{Path{"base", "port"}, "2:3", true},
+		// The paths through an alias or merge key point to it, since
+		// their keys are written elsewhere.
+		{Path{"other", "port"}, "6:8", false},
+		{Path{"svc", "port"}, "4:7", false},
+		{Path{"other"}, "6:1", true},
+		{Path{"svc", "missing"}, "<nil>", false},
+		{Path{"flow", "name"}, "7:8", true},
+		{Path{"flow", "replicas"}, "7:19", true},
+	} {
+		location := source.KeyLocation(0, test.path)
+		if position(location) != test.position {
+			t.Errorf("KeyLocation(%s) = %s, expected %s", test.path, position(location), test.position)
+		} else if location != nil && location.Key != test.key {
+			t.Errorf("KeyLocation(%s).Key = %t, expected %t", test.path, location.Key, test.key)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	source := testSource(t, "template.yml", `spec:
+  containers:
+  - name: app
+    ports: [80, 443]
+---
+kind: Service
+`)
+	for _, test := range []struct {
+		doc      int
+		path     Path
+		position string
+		found    bool
+	}{
+		{0, Path{"spec", "containers", "0", "name"}, "3:11", true},
+		{0, Path{"spec", "containers", "0", "ports", "1"}, "4:17", true},
+		{1, Path{"kind"}, "6:7", true},
+		// Missing paths resolve to their longest prefix that exists.
+		{0, Path{"spec", "containers", "0", "image"}, "3:5", false},
+		{0, Path{"spec", "containers", "1", "name"}, "3:3", false},
+		{0, Path{"spec", "containers", "0", "ports", "2"}, "4:12", false},
+		{1, Path{"spec"}, "5:1", false},
+		// There is nothing to point to in documents that don't exist.
+		{2, Path{"kind"}, "<nil>", false},
+		{-1, Path{}, "<nil>", false},
+	} {
+		location, found := source.Resolve(test.doc, test.path)
+		if position(location) != test.position || found != test.found {
+			t.Errorf("Resolve(%d, %s) = %s, %t, expected %s, %t",
+				test.doc, test.path, position(location), found, test.position, test.found)
+		}
+	}
+	if source.Location(2, Path{}) != nil || source.KeyLocation(2, Path{"kind"}) != nil ||
+		source.AnchorLocation(-1, Path{"kind"}) != nil {
+		t.Error("expected no locations in documents that don't exist")
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	source := testSource(t, "template.yml", "a: 1\nb: 2\nc: |\n  three\n  lines\nd: 4\n")
+	numbers := func(lines []Line) []int {
+		out := []int{}
+		for _, line := range lines {
+			out = append(out, line.Number)
+		}
+		return out
+	}
+	for _, test := range []struct {
+		path    Path
+		n       int
+		numbers []int
+	}{
+		{Path{"a"}, 0, []int{1}},
+		{Path{"a"}, 2, []int{1, 2, 3}},
+		{Path{"d"}, 1, []int{5, 6}},
+		{Path{"d"}, 10, []int{1, 2, 3, 4, 5, 6}},
+		// Multi-line values are included as a whole.
+		{Path{"c"}, 1, []int{3, 4, 5, 6}},
+	} {
+		lines := source.Location(0, test.path).WithContext(source, test.n)
+		if !reflect.DeepEqual(numbers(lines), test.numbers) {
+			t.Errorf("WithContext(%s, %d) = %v, expected lines %v", test.path, test.n, lines, test.numbers)
+		}
+	}
+	lines := source.Location(0, Path{"b"}).WithContext(source, 0)
+	if len(lines) != 1 || lines[0].Text != "b: 2" {
+		t.Errorf("expected the text of line 2, got %v", lines)
+	}
+}
+
+// TestTemplated checks that a Helm template still parses, and that values
+// with a placeholder show the template text.
+func TestTemplated(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deployment.yaml")
+	writeFile(t, file, `spec:
+{{- if .Values.replicas }}
+  replicas: {{ .Values.replicas }}
+{{- end }}
+  template:
+    image: "{{ .Values.image }}:1.0"
+    name: web
+`)
+	source, err := newSource(file, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path      Path
+		position  string
+		value     string
+		synthetic bool
+	}{
+		{Path{"spec", "replicas"}, "3:13", "{{ .Values.replicas }}", true},
+		{Path{"spec", "template", "image"}, "6:13", "{{ .Values.image }}:1.0", true},
+		{Path{"spec", "template", "name"}, "7:11", "web", false},
+	} {
+		location := source.Location(0, test.path)
+		if location == nil {
+			t.Errorf("%s: not found", test.path)
+		} else if position(location) != test.position || location.Value != test.value || location.Synthetic != test.synthetic {
+			t.Errorf("%s: got %s %q synthetic %t, expected %s %q synthetic %t", test.path,
+				position(location), location.Value, location.Synthetic, test.position, test.value, test.synthetic)
+		}
+	}
+}
+
+// TestComments checks that locations have the comment above their attribute,
+// and results the comment at the top of the document.
+func TestComments(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	input.kind == "Deployment"
+	msg := "not enough replicas"
+}
+`, "template.yml", `# The web frontend.
+
+kind: Deployment
+spec:
+  # Scaled down for now.
+  #   See the incident.
+  replicas: 1
+`, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Description != "The web frontend." {
+		t.Errorf("got description %q", results[0].Description)
+	}
+	comments := map[string]string{}
+	for _, location := range results[0].Findings[0].Locations {
+		comments[location.Path.String()] = location.Comment
+	}
+	expected := map[string]string{"kind": "", "spec.replicas": "Scaled down for now.\n  See the incident."}
+	if !reflect.DeepEqual(comments, expected) {
+		t.Errorf("got comments %q, expected %q", comments, expected)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.metadata.label
+	msg := "use labels rather than label"
+}
+`)
+	writeFile(t, template, "metadata:\n  label: web\n")
+	// Values by default, keys with Options.Keys.
+	for _, test := range []struct {
+		keys     bool
+		expected string
+	}{
+		{false, "2:10"},
+		{true, "2:3"},
+	} {
+		results, err := Infer(context.Background(), policy, template, Options{Keys: test.keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		locations := results[0].Findings[0].Locations
+		if len(locations) != 1 || position(&locations[0]) != test.expected || locations[0].Key != test.keys {
+			t.Errorf("Keys: %t: expected %s, got %v", test.keys, test.expected, locations)
+		}
+	}
+}
+
+// TestJSON runs the same policy against equivalent JSON and YAML templates.
+func TestJSON(t *testing.T) {
+	policy := `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	input.spec.ports[_] == 80
+	msg := "plain http"
+}
+`
+	for _, test := range []struct {
+		name     string
+		template string
+		expected []string
+	}{
+		// The port that isn't 80 didn't lead to the finding.
+		{
+			"template.yml",
+			"spec:\n  replicas: 1\n  ports: [80, 443]\n",
+			[]string{"2:13", "3:11"},
+		},
+		{
+			"template.json",
+			"{\n  \"spec\": {\"replicas\": 1, \"ports\": [80, 443]}\n}\n",
+			[]string{"2:24", "2:37"},
+		},
+	} {
+		results, err := scan(t, policy, test.name, test.template, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found := positions(results[0].Locations); !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, found, test.expected)
+		}
+		if len(results[0].Results) != 1 {
+			t.Errorf("%s: expected a single result, got %v", test.name, results[0].Results)
+		}
+	}
+}
+
+// TestScoped checks that attributes read by a rule that doesn't deny
+// anything are not part of the locations of the result.
+func TestScoped(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input.foo == "bar"
+	msg := "foo is bar"
+}
+
+deny[msg] {
+	input.replicas < 2
+	msg := "not enough replicas"
+}
+`, "template.yml", "foo: baz\nreplicas: 1\n", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := positions(results[0].Locations); !reflect.DeepEqual(found, []string{"2:11"}) {
+		t.Errorf("expected only replicas at 2:11, got %v", found)
+	}
+}
+
+// TestFormats checks that equivalent JSON, YAML and compressed templates give
+// the same paths, and that compression doesn't change the positions.
+func TestFormats(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	input.spec.ports[i] == 80
+	msg := sprintf("port %d", [i])
+}
+`)
+	yml := "spec:\n  replicas: 1\n  ports: [443, 80]\n"
+	json := "{\"spec\": {\"replicas\": 1, \"ports\": [443, 80]}}\n"
+	compress := func(text string) string {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		writer.Write([]byte(text))
+		writer.Close()
+		return buffer.String()
+	}
+	files := map[string]string{
+		"template.yml":     yml,
+		"template.json":    json,
+		"template.yml.gz":  compress(yml),
+		"template.json.gz": compress(json),
+		"template.b64":     base64.StdEncoding.EncodeToString([]byte(compress(yml))),
+	}
+	locations := map[string][]string{}
+	for name, text := range files {
+		file := filepath.Join(dir, name)
+		writeFile(t, file, text)
+		results, err := Infer(context.Background(), policy, file, Options{Base64: name == "template.b64"})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		for _, location := range results[0].Locations {
+			locations[name] = append(locations[name], fmt.Sprintf("%s@%d:%d", location.Path, location.Line, location.Column))
+		}
+	}
+	expected := map[string][]string{
+		"template.yml":     {"spec.replicas@2:13", "spec.ports[1]@3:16"},
+		"template.json":    {"spec.replicas@1:23", "spec.ports[1]@1:41"},
+		"template.yml.gz":  {"spec.replicas@2:13", "spec.ports[1]@3:16"},
+		"template.json.gz": {"spec.replicas@1:23", "spec.ports[1]@1:41"},
+		"template.b64":     {"spec.replicas@2:13", "spec.ports[1]@3:16"},
+	}
+	if !reflect.DeepEqual(locations, expected) {
+		t.Errorf("got %v, expected %v", locations, expected)
+	}
+}
+
+// TestStdin checks that templates are read only once, since stdin can't be
+// read again.
+func TestStdin(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, "package policy\n\ndeny[msg] {\n\tinput.spec.replicas < 2\n\tmsg := \"replicas\"\n}\n")
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = reader
+	defer func() { os.Stdin = stdin }()
+	if _, err := writer.WriteString("spec:\n  replicas: 1\n"); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	results, err := Infer(context.Background(), policy, Stdin, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := positions(results[0].Locations); !reflect.DeepEqual(found, []string{"2:13"}) {
+		t.Errorf("got %v, expected 2:13", found)
+	} else if file := results[0].Locations[0].File; file != "<stdin>" {
+		t.Errorf("got file %s, expected <stdin>", file)
+	}
+}
+
+// TestReads checks that Options.Reads lists attributes that didn't lead to a
+// finding as well, while the findings only have their own.
+func TestReads(t *testing.T) {
+	policy := `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "replicas"
+}
+
+deny[msg] {
+	input.spec.image == "latest"
+	input.metadata.name
+	msg := "image"
+}
+`
+	template := "metadata:\n  name: web\nspec:\n  replicas: 1\n  image: nginx\n"
+	for _, reads := range []bool{false, true} {
+		results, err := scan(t, policy, "template.yml", template, Options{Reads: reads})
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths := []string{}
+		for _, location := range results[0].Reads {
+			paths = append(paths, location.Path.Pointer())
+		}
+		expected := []string{}
+		if reads {
+			expected = []string{"/spec/replicas", "/spec/image"}
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("Reads: %t: got %v, expected %v", reads, paths, expected)
+		}
+		if len(results[0].Locations) != 1 || results[0].Locations[0].Path.Pointer() != "/spec/replicas" {
+			t.Errorf("Reads: %t: unexpected locations %v", reads, results[0].Locations)
+		}
+	}
+}
+
+// TestDuplicateKeys checks that keys defined twice are reported as a
+// warning at both keys, and that the last value is the one that is used.
+func TestDuplicateKeys(t *testing.T) {
+	policy := `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "replicas"
+}
+`
+	for _, test := range []struct {
+		name     string
+		template string
+		expected []string
+	}{
+		{"template.yml", "spec:\n  replicas: 3\n  replicas: 1\n", []string{"2:3", "3:3"}},
+		{"template.json", `{"spec": {"replicas": 3, "replicas": 1}}`, []string{"1:12", "1:27"}},
+	} {
+		results, err := scan(t, policy, test.name, test.template, Options{})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(results[0].Findings) != 1 || results[0].Locations[0].Value != "1" {
+			t.Errorf("%s: expected the last value to be used, got %+v", test.name, results[0].Locations)
+		}
+		if len(results) != 2 || results[1].Query != DuplicateQuery || len(results[1].Findings) != 1 {
+			t.Fatalf("%s: expected a duplicate key warning, got %+v", test.name, results)
+		}
+		finding := results[1].Findings[0]
+		if found := positions(finding.Locations); finding.Severity != SeverityWarning ||
+			!reflect.DeepEqual(found, test.expected) {
+			t.Errorf("%s: got %s at %v, expected a warning at %v", test.name, finding.Severity, found, test.expected)
+		}
+		if !strings.Contains(finding.Message, test.name+":"+test.expected[0]) ||
+			!strings.Contains(finding.Message, test.name+":"+test.expected[1]) {
+			t.Errorf("%s: the message doesn't mention both keys: %s", test.name, finding.Message)
+		}
+	}
+}
+
+// TestDocuments checks that every document of a template is evaluated on its
+// own, with locations in that document.
+func TestDocuments(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input.kind == "Service"
+	msg := input.metadata.name
+}
+`, "template.yml", `kind: Deployment
+metadata:
+  name: web
+---
+kind: Service
+metadata:
+  name: web
+---
+kind: Service
+metadata:
+  name: api
+`, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected a result for each of the 3 documents, got %d", len(results))
+	}
+	for i, result := range results {
+		if result.Document != i {
+			t.Errorf("result %d is for document %d", i, result.Document)
+		}
+	}
+	if deny := results[0].Results[0].Expressions[0].Value; !reflect.DeepEqual(deny, []interface{}{}) {
+		t.Errorf("expected nothing denied for the deployment, got %v", deny)
+	}
+	for i, expected := range map[int][]string{1: {"5:7", "7:9"}, 2: {"9:7", "11:9"}} {
+		if found := positions(results[i].Locations); !reflect.DeepEqual(found, expected) {
+			t.Errorf("document %d: got %v, expected %v", i, found, expected)
+		}
+	}
+}
+
+// TestQuery evaluates a deny rule outside of the default package.
+func TestQuery(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package terraform
+
+deny[msg] {
+	input.resource.bucket.acl == "public-read"
+	msg := "public bucket"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "resource:\n  bucket:\n    acl: public-read\n")
+	results, err := Infer(context.Background(), policy, template, Options{Queries: []string{"data.terraform.deny"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"3:10"}
+	if found := positions(results[0].Locations); !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+	if deny := results[0].Results[0].Expressions[0].Value; !reflect.DeepEqual(deny, []interface{}{"public bucket"}) {
+		t.Errorf("got %v, expected the public bucket", deny)
+	}
+}
+
+// TestQueries evaluates two rule sets in one run, each with its own results
+// and locations.
+func TestQueries(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "security.rego"), `package security
+
+deny[msg] {
+	input.spec.privileged
+	msg := "privileged"
+}
+`)
+	writeFile(t, filepath.Join(dir, "cost.rego"), `package cost
+
+deny[msg] {
+	input.spec.replicas > 10
+	msg := "too many replicas"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "spec:\n  privileged: true\n  replicas: 20\n")
+	scanner, err := NewScanner([]string{dir}, Options{
+		Queries: []string{"data.security.deny", "data.cost.deny"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := scanner.Scan(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string][]string{}
+	for _, result := range results {
+		found[result.Query] = positions(result.Locations)
+	}
+	expected := map[string][]string{
+		"data.security.deny": {"2:15"},
+		"data.cost.deny":     {"3:13"},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+}
+
+// TestDiscover checks that deny, warn and violation rules are found in
+// whatever package they are declared when there is no query.
+func TestDiscover(t *testing.T) {
+	results, err := scan(t, `package foo.bar
+
+deny[msg] {
+	input.replicas < 2
+	msg := "not enough replicas"
+}
+
+warn[msg] {
+	input.image == "latest"
+	msg := "image is not pinned"
+}
+
+allow {
+	input.image != "latest"
+}
+`, "template.yml", "replicas: 1\nimage: latest\n", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string][]string{}
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			found[result.Query] = append(found[result.Query], finding.Message)
+		}
+	}
+	expected := map[string][]string{
+		"data.foo.bar.deny": {"not enough replicas"},
+		"data.foo.bar.warn": {"image is not pinned"},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+}
+
+// TestSeverity checks that findings get the severity of their rule, in the
+// results and in the output.
+func TestSeverity(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input.replicas < 2
+	msg := "not enough replicas"
+}
+
+warn[msg] {
+	input.image == "latest"
+	msg := "image is not pinned"
+}
+`, "template.yml", "replicas: 1\nimage: latest\n", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	severities := map[string]string{}
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			severities[finding.Message] = result.Severity
+		}
+	}
+	expected := map[string]string{
+		"not enough replicas": SeverityError,
+		"image is not pinned": SeverityWarning,
+	}
+	if !reflect.DeepEqual(severities, expected) {
+		t.Errorf("got %v, expected %v", severities, expected)
+	}
+
+	var text, sarif bytes.Buffer
+	if err := writeText(&text, results, palette{}); err != nil {
+		t.Fatal(err)
+	} else if err := writeSARIF(&sarif, results); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Finding (error): not enough replicas", "Finding (warning): image is not pinned"} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("expected %q in the output:\n%s", expected, text.String())
+		}
+	}
+	for _, expected := range []string{`"level": "error"`, `"level": "warning"`} {
+		if !strings.Contains(sarif.String(), expected) {
+			t.Errorf("expected %q in the SARIF output:\n%s", expected, sarif.String())
+		}
+	}
+}
+
+// TestStructured checks that objects produced by deny rules are split into
+// their message and metadata, and that strings and objects without a message
+// still work.
+func TestStructured(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[{"msg": msg, "severity": "warning", "id": "R001"}] {
+	input.spec.replicas < 2
+	msg := "run at least two replicas"
+}
+
+deny[msg] {
+	input.spec.ports[_] == 80
+	msg := "plain http"
+}
+
+deny[{"id": "R002"}] {
+	input.spec.image == "nginx"
+}
+`, "template.yml", "spec:\n  replicas: 1\n  ports: [80]\n  image: nginx\n", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		severity string
+		metadata map[string]interface{}
+	}
+	found := map[string]summary{}
+	for _, finding := range results[0].Findings {
+		found[finding.Message] = summary{finding.Severity, finding.Metadata}
+	}
+	expected := map[string]summary{
+		"run at least two replicas": {SeverityWarning, map[string]interface{}{"id": "R001", "severity": "warning"}},
+		"plain http":                {SeverityError, nil},
+		`{"id":"R002"}`:             {SeverityError, nil},
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+}
+
+// TestResultSet checks that the result set of the query is returned as rego
+// produced it, and that every finding has its value from it.
+func TestResultSet(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[{"msg": "run at least two replicas", "id": "R001"}] {
+	input.spec.replicas < 2
+}
+`, "template.yml", "spec:\n  replicas: 1\n", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := map[string]interface{}{"msg": "run at least two replicas", "id": "R001"}
+	resultSet := results[0].Results
+	if len(resultSet) != 1 || len(resultSet[0].Expressions) != 1 {
+		t.Fatalf("expected a single expression, got %v", resultSet)
+	}
+	expression := resultSet[0].Expressions[0]
+	if expression.Text != "data.policy.deny" || !reflect.DeepEqual(expression.Value, []interface{}{value}) {
+		t.Errorf("got %s = %v, expected data.policy.deny = %v", expression.Text, expression.Value, []interface{}{value})
+	}
+	if finding := results[0].Findings[0]; !reflect.DeepEqual(finding.Value, value) {
+		t.Errorf("got finding value %v, expected %v", finding.Value, value)
+	}
+}
+
+// TestRules checks that findings point to the rule that produced them as
+// well as to the attributes in the template.
+func TestRules(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.image == "latest"
+	msg := "image is not pinned"
+}
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "not enough replicas"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "image: nginx\nspec:\n  replicas: 1\n")
+	results, err := Infer(context.Background(), policy, template, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finding := results[0].Findings[0]
+	if expected := []Rule{{Name: "deny", File: policy, Line: 8, Column: 1}}; !reflect.DeepEqual(finding.Rules, expected) {
+		t.Errorf("got rules %v, expected %v", finding.Rules, expected)
+	}
+	if found := positions(finding.Locations); !reflect.DeepEqual(found, []string{"3:13"}) {
+		t.Errorf("got locations %v, expected 3:13", found)
+	}
+	var output bytes.Buffer
+	if err := writeText(&output, results, palette{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Rule: deny at " + policy + ":8", "Location: " + template + ":3:13"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("expected %q in the output:\n%s", expected, output.String())
+		}
+	}
+}
+
+// TestExplain checks that each location lists the expressions that read it,
+// including the ones in the body of a function.
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+latest(image) {
+	endswith(image, ":latest")
+}
+
+deny[msg] {
+	container := input.spec.containers[_]
+	latest(container.image)
+	msg := sprintf("%s uses latest", [container.name])
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "spec:\n  containers:\n  - name: app\n    image: app:latest\n")
+	results, err := Infer(context.Background(), policy, template, Options{Explain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	explanations := map[string][]string{}
+	for _, location := range results[0].Findings[0].Locations {
+		for _, step := range location.Explanation {
+			explanations[location.Path.String()] = append(explanations[location.Path.String()], step.String())
+		}
+	}
+	expected := map[string][]string{
+		// The compiler moves arguments out of calls, into expressions
+		// of their own.
+		"spec.containers[0].image": {
+			policy + ":9: container.image",
+			policy + ":9: latest(container.image)",
+			policy + ":4: endswith(image, \":latest\")",
+		},
+		"spec.containers[0].name": {
+			policy + ":10: container.name",
+			policy + ":10: sprintf(\"%s uses latest\", [container.name])",
+		},
+	}
+	if !reflect.DeepEqual(explanations, expected) {
+		t.Errorf("got %v, expected %v", explanations, expected)
+	}
+	var output bytes.Buffer
+	if err := writeText(&output, results, palette{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "    Read by: " + policy + ":4: endswith(image, \":latest\")\n"; !strings.Contains(output.String(), expected) {
+		t.Errorf("expected %q in the output:\n%s", expected, output.String())
+	}
+}
+
+// TestResource checks that results of Kubernetes manifests name the resource
+// next to the locations, and that other documents don't have one.
+func TestResource(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, "package policy\n\ndeny[msg] {\n\tinput.spec.replicas < 2\n\tmsg := \"replicas\"\n}\n")
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1
+---
+spec:
+  replicas: 1
+`)
+	results, err := Infer(context.Background(), policy, template, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resource := results[0].Resource; resource == nil || *resource != (Resource{Kind: "Deployment", Name: "web"}) {
+		t.Errorf("got resource %v, expected Deployment/web", resource)
+	} else if resource := results[1].Resource; resource != nil {
+		t.Errorf("got resource %v for a document without a kind", resource)
+	}
+	var output bytes.Buffer
+	if err := writeText(&output, results[:1], palette{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "  Resource: Deployment/web\n  Rule: deny at " + policy + ":3\n  Location: " + template + ":6:13"; !strings.Contains(output.String(), expected) {
+		t.Errorf("expected %q in the output:\n%s", expected, output.String())
+	}
+}
+
+// TestPath infers a path through a list element.
+func TestPath(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.spec.containers[0].image == "nginx"
+	msg := "nginx"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "spec:\n  containers:\n    - name: web\n      image: nginx\n")
+	results, err := Infer(context.Background(), policy, template, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Location{{
+		File: template, Line: 4, Column: 14, EndLine: 4, EndColumn: 19,
+		Path: Path{"spec", "containers", "0", "image"}, Value: "nginx",
+		arrays: []bool{false, false, true, false},
+	}}
+	if locations := results[0].Locations; !reflect.DeepEqual(locations, expected) {
+		t.Errorf("got %v, expected %v", results[0].Locations, expected)
+	}
+}
+
+// TestValues checks that locations show the value written in the source,
+// and a summary for objects and arrays.
+func TestValues(t *testing.T) {
+	long := strings.Repeat("x", 80)
+	source := testSource(t, "template.yml", `image: nginx:latest
+spec:
+  ports: [80, 443]
+  selector: {app: web}
+command: |
+  one
+  two
+long: `+long+`
+`)
+	for _, test := range []struct {
+		path     Path
+		expected string
+	}{
+		{Path{"image"}, "nginx:latest"},
+		{Path{"spec"}, "{2 keys}"},
+		{Path{"spec", "ports"}, "[2 items]"},
+		{Path{"spec", "ports", "1"}, "443"},
+		{Path{"command"}, `one\ntwo\n`},
+		{Path{"long"}, strings.Repeat("x", 57) + "..."},
+	} {
+		if location := source.Location(0, test.path); location == nil || location.Value != test.expected {
+			t.Errorf("%s: got %v, expected %q", test.path, location, test.expected)
+		}
+	}
+	// Keys are reported with the value they are the key of.
+	if location := source.KeyLocation(0, Path{"image"}); location == nil || location.Value != "nginx:latest" {
+		t.Errorf("got %v for the key of image", location)
+	}
+}
+
+func TestPathPointer(t *testing.T) {
+	for _, test := range []struct {
+		path    Path
+		pointer string
+	}{
+		{Path{}, ""},
+		{Path{"spec", "containers", "0", "image"}, "/spec/containers/0/image"},
+		{Path{"metadata", "annotations", "example.com/owner"}, "/metadata/annotations/example.com~1owner"},
+		{Path{"a~b", "~1"}, "/a~0b/~01"},
+	} {
+		if pointer := test.path.Pointer(); pointer != test.pointer {
+			t.Errorf("Pointer(%q) = %q, expected %q", test.path, pointer, test.pointer)
+		}
+	}
+}
+
+func TestPathString(t *testing.T) {
+	for _, test := range []struct {
+		path Path
+		rego string
+	}{
+		{Path{"spec", "containers", "0", "image"}, "spec.containers[0].image"},
+		{Path{"metadata", "annotations", "example.com/owner"}, `metadata.annotations["example.com/owner"]`},
+		{Path{"a~b", "c"}, `["a~b"].c`},
+	} {
+		if rego := test.path.String(); rego != test.rego {
+			t.Errorf("String(%q) = %s, expected %s", []string(test.path), rego, test.rego)
+		}
+	}
+}
+
+func TestLocationRego(t *testing.T) {
+	source := testSource(t, "template.yml", `ports:
+  80: http
+spec:
+  containers:
+  - image: app
+  labels:
+    app.kubernetes.io/name: web
+`)
+	for _, test := range []struct {
+		path Path
+		rego string
+	}{
+		{Path{"ports", "80"}, `input.ports["80"]`},
+		{Path{"spec", "containers", "0", "image"}, `input.spec.containers[0].image`},
+		{Path{"spec", "labels", "app.kubernetes.io/name"}, `input.spec.labels["app.kubernetes.io/name"]`},
+	} {
+		location := source.Location(0, test.path)
+		if location == nil {
+			t.Errorf("Location(%s) not found", test.path)
+		} else if rego := location.Rego(); rego != test.rego {
+			t.Errorf("Rego(%s) = %s, expected %s", test.path, rego, test.rego)
+		}
+	}
+
+	array := testSource(t, "template.yml", "- name: a\n- name: b\n")
+	if rego := array.Location(0, Path{"1", "name"}).Rego(); rego != "input[1].name" {
+		t.Errorf("Rego([1].name) = %s, expected input[1].name", rego)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.d == input.b
+	input.c != input.a
+	input.nested.z == input.nested.y
+	msg := "same"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "a: 1\nb: 2\nc: 3\nd: 2\nnested: {y: 0, z: 0}\n")
+	var first []string
+	for i := 0; i < 20; i++ {
+		results, err := Infer(context.Background(), policy, template, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		locations := []string{}
+		for _, location := range results[0].Locations {
+			locations = append(locations, location.String())
+		}
+		if first == nil {
+			first = locations
+			expected := []string{
+				template + ":1:4", template + ":2:4", template + ":3:4", template + ":4:4",
+				template + ":5:13", template + ":5:19",
+			}
+			if !reflect.DeepEqual(locations, expected) {
+				t.Fatalf("got %v, expected %v", locations, expected)
+			}
+		} else if !reflect.DeepEqual(locations, first) {
+			t.Fatalf("run %d got %v, the first run %v", i, locations, first)
+		}
+	}
+}
+
+// TestAliases uses an anchor reused in two places, through a merge key and
+// through an alias.  Both are reported where they are used.
+func TestAliases(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input[name].port < 1024
+	msg := sprintf("%s uses a privileged port", [name])
+}
+`, "template.yml", `defaults: &defaults
+  port: 80
+web:
+  <<: *defaults
+  name: web
+api: *defaults
+`, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, found := []string{"2:9", "4:7", "6:6"}, positions(results[0].Locations); !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+	if len(results[0].Unresolved) != 0 {
+		t.Errorf("expected all paths to resolve, got %v", results[0].Unresolved)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	for _, text := range []string{"", "# Just a comment\n", "---\n", "---\n# Nothing\n---\n"} {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "policy.rego"), "package policy\n\ndeny[msg] {\n\tmsg := input.x\n}\n")
+		writeFile(t, filepath.Join(dir, "template.yml"), text)
+		_, err := Infer(context.Background(), filepath.Join(dir, "policy.rego"), filepath.Join(dir, "template.yml"), Options{})
+		var parseError *ParseError
+		if !errors.As(err, &parseError) || !strings.Contains(err.Error(), "empty document") {
+			t.Errorf("%q: expected an empty document error, got %v", text, err)
+		}
+	}
+
+	// Empty documents in between are skipped, but still counted.
+	results, err := scan(t, "package policy\n\ndeny[msg] {\n\tmsg := input.x\n}\n", "template.yml", "x: a\n---\n---\nx: b\n---\n", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := []string{}
+	for _, result := range results {
+		found = append(found, fmt.Sprintf("%d %s", result.Document, result.Findings[0].Message))
+	}
+	if expected := []string{"0 a", "2 b"}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+}
+
+// listRecursive is a straightforward reference for PathTree.List.
+func listRecursive(tree PathTree, prefix Path) []Path {
+	if len(tree) == 0 {
+		if len(prefix) == 0 {
+			return []Path{}
+		}
+		return []Path{append(Path{}, prefix...)}
+	}
+	out := []Path{}
+	for k, child := range tree {
+		out = append(out, listRecursive(child, append(prefix, k))...)
+	}
+	return out
+}
+
+func TestPathTree(t *testing.T) {
+	tree := PathTree{}
+	for _, path := range []Path{
+		{"spec", "containers", "10", "image"},
+		{"spec", "containers", "2", "image"},
+		{"spec", "containers", "2"},
+		{"spec", "replicas"},
+		{"metadata"},
+		{"metadata", "name"},
+	} {
+		tree.Insert(path)
+	}
+	// Overlapping paths only keep the longest one, and indices are sorted as
+	// numbers.
+	expected := []Path{
+		{"metadata", "name"},
+		{"spec", "containers", "2", "image"},
+		{"spec", "containers", "10", "image"},
+		{"spec", "replicas"},
+	}
+	if paths := tree.Paths(); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Paths() = %v, expected %v", paths, expected)
+	}
+	// List is iterative, it finds the same paths as the recursive version.
+	sortPaths := func(paths []Path) {
+		sort.Slice(paths, func(i, j int) bool { return comparePaths(paths[i], paths[j]) < 0 })
+	}
+	list, reference := tree.List(), listRecursive(tree, Path{})
+	sortPaths(list)
+	sortPaths(reference)
+	if !reflect.DeepEqual(list, reference) {
+		t.Errorf("List() = %v, expected %v", list, reference)
+	}
+	if paths := (PathTree{}).List(); len(paths) != 0 {
+		t.Errorf("an empty tree has no paths, got %v", paths)
+	}
+	if !tree.Contains(Path{"spec", "containers"}) || tree.Contains(Path{"spec", "name"}) {
+		t.Error("Contains should find prefixes but not other paths")
+	}
+	if prefixes := tree.Prefixes(); len(prefixes) != 9 {
+		t.Errorf("Prefixes() = %v, expected 9 paths", prefixes)
+	}
+}
+
+// TestAnnotate checks that every term of the input can be traced back to
+// its path through the side table.
+func TestAnnotate(t *testing.T) {
+	value, err := ast.InterfaceToValue(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []interface{}{map[string]interface{}{"image": "app"}},
+			"80":         "http",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := ast.NewTerm(value)
+	tracer := newLocationTracer()
+	annotate(Path{"root"}, input, tracer.paths)
+	spec := input.Get(ast.StringTerm("spec"))
+	image := spec.Get(ast.StringTerm("containers")).Get(ast.IntNumberTerm(0)).Get(ast.StringTerm("image"))
+	for _, test := range []struct {
+		term *ast.Term
+		path Path
+	}{
+		{input, Path{"root"}},
+		{spec, Path{"root", "spec"}},
+		{spec.Get(ast.StringTerm("80")), Path{"root", "spec", "80"}},
+		{image, Path{"root", "spec", "containers", "0", "image"}},
+	} {
+		if path, ok := tracer.path(test.term); !ok || !reflect.DeepEqual(path, test.path) {
+			t.Errorf("path(%v) = %v, %t, expected %v", test.term, path, ok, test.path)
+		}
+	}
+	if _, ok := tracer.path(ast.StringTerm("app")); ok {
+		t.Error("expected no path for a term that is not in the input")
+	}
+}
+
+// scanFixture writes n templates into a directory, every other one failing
+// the policy, and returns the policy and the directory.
+func scanFixture(t testing.TB, n int) (string, string) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	if err := os.WriteFile(policy, []byte(`package policy
+
+deny[msg] {
+	container := input.spec.containers[_]
+	not container.resources.limits.memory
+	msg := sprintf("%s has no memory limit", [container.name])
+}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	templates := filepath.Join(dir, "templates")
+	if err := os.MkdirAll(filepath.Join(templates, "nested"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		limits := "\n      resources: {limits: {memory: 1Gi}}"
+		if i%2 == 1 {
+			limits = ""
+		}
+		text := fmt.Sprintf("kind: Pod\nmetadata:\n  name: pod-%d\nspec:\n  containers:\n    - name: app%s\n", i, limits)
+		file := filepath.Join(templates, fmt.Sprintf("pod-%03d.yaml", i))
+		if i%3 == 0 {
+			file = filepath.Join(templates, "nested", fmt.Sprintf("pod-%03d.yml", i))
+		}
+		if err := os.WriteFile(file, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not a template.
+	if err := os.WriteFile(filepath.Join(templates, "README.md"), []byte("# Pods\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return policy, templates
+}
+
+// summarize renders results as one line per finding, to compare them.
+func summarize(results []*Result) []string {
+	out := []string{}
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			line := fmt.Sprintf("%s %d %s", result.File, result.Document, finding.Message)
+			for _, location := range finding.Locations {
+				line += " " + location.String()
+			}
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+func TestScanner(t *testing.T) {
+	policy, templates := scanFixture(t, 10)
+	scanner, err := NewScanner([]string{policy}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(templates, "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reusing the prepared query gives the same results as preparing it for
+	// every template.
+	failing := 0
+	for _, file := range files {
+		scanned, err := scanner.Scan(context.Background(), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inferred, err := Infer(context.Background(), policy, file, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(summarize(scanned), summarize(inferred)) {
+			t.Errorf("%s: Scan gave %v, Infer gave %v", file, summarize(scanned), summarize(inferred))
+		}
+		failing += len(summarize(scanned))
+	}
+	if failing != 3 {
+		t.Errorf("expected 3 failing templates, got %d", failing)
+	}
+}
+
+func TestScanDir(t *testing.T) {
+	policy, templates := scanFixture(t, 12)
+	scanner, err := NewScanner([]string{policy}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := scanner.ScanDir(context.Background(), templates, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 12 {
+		t.Fatalf("expected a result for each of the 12 templates, got %d", len(results))
+	}
+	// The results are in the order of the walk, and the odd templates fail.
+	files, expected := []string{}, []string{}
+	for _, i := range []int{0, 3, 6, 9, 1, 2, 4, 5, 7, 8, 10, 11} {
+		file := filepath.Join(templates, fmt.Sprintf("pod-%03d.yaml", i))
+		if i%3 == 0 {
+			file = filepath.Join(templates, "nested", fmt.Sprintf("pod-%03d.yml", i))
+		}
+		files = append(files, file)
+		if i%2 == 1 {
+			expected = append(expected, fmt.Sprintf("%s 0 app has no memory limit %s:6:13", file, file))
+		}
+	}
+	for i, result := range results {
+		if result.File != files[i] {
+			t.Errorf("result %d is for %s, expected %s", i, result.File, files[i])
+		}
+	}
+	if found := summarize(results); !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+
+	// The glob only selects some of the files.
+	results, err = scanner.ScanDir(context.Background(), templates, "*.yml")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(results) != 4 {
+		t.Errorf("expected 4 results for *.yml, got %d", len(results))
+	}
+
+	// Of several invalid templates, the first one in the walk is reported.
+	for _, name := range []string{"pod-004.yaml", "pod-010.yaml"} {
+		writeFile(t, filepath.Join(templates, name), "kind: [Pod\n")
+	}
+	_, err = scanner.ScanDir(context.Background(), templates, "")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.File != filepath.Join(templates, "pod-004.yaml") {
+		t.Errorf("expected a ParseError for pod-004.yaml, got %v", err)
+	}
+}
+
+// TestScanConcurrent scans templates with the same scanner from several
+// goroutines, run it with -race.  Every evaluation gets its own tracers, so
+// the results are the same as when scanning one at a time.
+func TestScanConcurrent(t *testing.T) {
+	policy, templates := scanFixture(t, 8)
+	scanner, err := NewScanner([]string{policy}, Options{Reads: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(templates, "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{}
+	for _, file := range files {
+		results, err := scanner.Scan(context.Background(), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[file] = summarize(results)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*len(files))
+	for w := 0; w < 4; w++ {
+		for _, file := range files {
+			wg.Add(1)
+			go func(file string) {
+				defer wg.Done()
+				results, err := scanner.Scan(context.Background(), file)
+				if err != nil {
+					errs <- err
+				} else if found := summarize(results); !reflect.DeepEqual(found, expected[file]) {
+					errs <- fmt.Errorf("%s: got %v, expected %v", file, found, expected[file])
+				}
+			}(file)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestLocationTracerReset(t *testing.T) {
+	tracer := newLocationTracer()
+	tracer.tree.Insert(Path{"a", "b"})
+	tracer.reset()
+	if len(tracer.tree) != 0 {
+		t.Errorf("expected no paths after reset, got %v", tracer.tree.List())
+	}
+}
+
+func TestNewScannerFromModules(t *testing.T) {
+	module, err := ast.ParseModule("memory.rego", `package policy
+
+deny[msg] {
+	input.replicas < 2
+	msg := "not enough replicas"
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner, err := NewScannerFromModules(map[string]*ast.Module{"memory.rego": module}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := filepath.Join(t.TempDir(), "template.yml")
+	writeFile(t, template, "name: web\nreplicas: 1\n")
+	results, err := scanner.Scan(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(results) != 1 || len(results[0].Findings) != 1 {
+		t.Fatalf("expected a single finding, got %v", results)
+	}
+	finding := results[0].Findings[0]
+	if len(finding.Locations) != 1 || position(&finding.Locations[0]) != "2:11" {
+		t.Errorf("expected replicas at 2:11, got %v", finding.Locations)
+	} else if len(finding.Rules) != 1 || finding.Rules[0].File != "memory.rego" {
+		t.Errorf("expected the rule in memory.rego, got %v", finding.Rules)
+	}
+}
+
+// TestPolicyDir loads a directory of policies, where one imports helpers from
+// another and tests are left out, together with a data file.
+func TestPolicyDir(t *testing.T) {
+	dir := t.TempDir()
+	policies := filepath.Join(dir, "policies")
+	if err := os.MkdirAll(filepath.Join(policies, "lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(policies, "main.rego"), `package main
+
+import data.lib.registries
+
+deny[msg] {
+	image := input.spec.containers[_].image
+	not registries.allowed(image)
+	msg := sprintf("%s is not from an allowed registry", [image])
+}
+`)
+	writeFile(t, filepath.Join(policies, "lib", "registries.rego"), `package lib.registries
+
+allowed(image) {
+	startswith(image, data.registries[_])
+}
+`)
+	writeFile(t, filepath.Join(policies, "main_test.rego"), "package main\n\ntest_broken { undefined_fn(1) }\n")
+	writeFile(t, filepath.Join(policies, "notes.txt"), "not a policy\n")
+	config := filepath.Join(dir, "config.yml")
+	writeFile(t, config, "registries: [registry.example.com/]\n")
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, `spec:
+  containers:
+    - image: registry.example.com/app
+    - image: docker.io/sidecar
+`)
+	scanner, err := NewScanner([]string{policies}, Options{Queries: []string{"data.main.deny"}, Data: []string{config}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := scanner.Scan(context.Background(), template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{template + " 0 docker.io/sidecar is not from an allowed registry " + template + ":4:14"}
+	if found := summarize(results); !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+}
+
+// BenchmarkPathTree measures building and listing the paths of a deeply
+// nested document, as annotate and the tracer do.
+func BenchmarkPathTree(b *testing.B) {
+	paths := []Path{}
+	path := Path{}
+	for i := 0; i < 200; i++ {
+		path = append(path, "child")
+		paths = append(paths, append(append(Path{}, path...), "name"), append(append(Path{}, path...), "size"))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := PathTree{}
+		for _, path := range paths {
+			tree.Insert(path)
+		}
+		tree.Walk(func(Path) {})
+	}
+}
+
+// deepTemplate writes a template nested depth levels deep, with a few
+// attributes at every level.
+func deepTemplate(b *testing.B, depth int) string {
+	var builder strings.Builder
+	for i := 0; i < depth; i++ {
+		indent := strings.Repeat("  ", i)
+		fmt.Fprintf(&builder, "%sname: level-%d\n%ssize: %d\n%schild:\n", indent, i, indent, i, indent)
+	}
+	fmt.Fprintf(&builder, "%sleaf: true\n", strings.Repeat("  ", depth))
+	file := filepath.Join(b.TempDir(), "deep.yml")
+	if err := os.WriteFile(file, []byte(builder.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	return file
+}
+
+// BenchmarkDeep scans a document nested 200 levels deep with a policy that
+// reads every level.
+func BenchmarkDeep(b *testing.B) {
+	template := deepTemplate(b, 200)
+	policy := filepath.Join(b.TempDir(), "policy.rego")
+	if err := os.WriteFile(policy, []byte(`package policy
+
+deny[msg] {
+	walk(input, [path, value])
+	path[count(path) - 1] == "leaf"
+	msg := "leaf"
+}
+`), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	scanner, err := NewScanner([]string{policy}, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := scanner.Scan(context.Background(), template); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInfer(b *testing.B) {
+	policy, templates := scanFixture(b, 20)
+	files, _ := filepath.Glob(filepath.Join(templates, "*.yaml"))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, file := range files {
+			if _, err := Infer(context.Background(), policy, file, Options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	policy, templates := scanFixture(b, 20)
+	files, _ := filepath.Glob(filepath.Join(templates, "*.yaml"))
+	scanner, err := NewScanner([]string{policy}, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, file := range files {
+			if _, err := scanner.Scan(context.Background(), file); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkScanDir scans templates in parallel, compare with -cpu 1,4.
+func BenchmarkScanDir(b *testing.B) {
+	policy, templates := scanFixture(b, 100)
+	scanner, err := NewScanner([]string{policy}, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := scanner.ScanDir(context.Background(), templates, ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLarge scans a template with many resources, where the tracer
+// looks up the paths of a lot of terms.
+func BenchmarkLarge(b *testing.B) {
+	dir := b.TempDir()
+	var builder strings.Builder
+	builder.WriteString("Resources:\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&builder, "  Subnet%d:\n    Type: AWS::EC2::Subnet\n    Properties:\n      CidrBlock: 10.%d.%d.0/%d\n",
+			i, i/256, i%256, 16+i%16)
+	}
+	template := filepath.Join(dir, "template.yml")
+	if err := os.WriteFile(template, []byte(builder.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	scanner, err := NewScanner([]string{"policy.rego"}, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := scanner.Scan(context.Background(), template); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestNoEval compares the attributes found without evaluating the policy with
+// its references to the input.
+func TestNoEval(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	container := input.spec.containers[i]
+	container.image == "latest"
+	input.missing.attribute
+	msg := "x"
+}
+`, "template.yml", "spec:\n  replicas: 1\n  containers:\n    - image: latest\n", Options{NoEval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Query != StaticQuery || len(results[0].Findings) != 0 {
+		t.Fatalf("expected a single static result without findings, got %+v", results)
+	}
+	reads := []string{}
+	for _, location := range results[0].Reads {
+		reads = append(reads, fmt.Sprintf("%s@%d:%d", location.Path, location.Line, location.Column))
+	}
+	unresolved := []string{}
+	for _, path := range results[0].Unresolved {
+		unresolved = append(unresolved, path.String())
+	}
+	if expected := []string{"spec.replicas@2:13", "spec.containers@4:5"}; !reflect.DeepEqual(reads, expected) {
+		t.Errorf("got %v, expected %v", reads, expected)
+	}
+	if expected := []string{"missing.attribute"}; !reflect.DeepEqual(unresolved, expected) {
+		t.Errorf("got unresolved %v, expected %v", unresolved, expected)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	policy := "package policy\n\ndeny[msg] {\n\tinput.name == \"web\"\n\tmsg := \"web\"\n}\n"
+	var output bytes.Buffer
+	options := Options{Logger: log.New(&output, "", 0)}
+	if _, err := scan(t, policy, "template.yml", "name: web\n", options); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"name": "web"`, "input.name = \"web\"", "Exit data.policy.deny"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("expected %q in the debug output:\n%s", expected, output.String())
+		}
+	}
+}
+
+// TestBase checks that files are reported relative to Options.Base, with
+// forward slashes, unless they are outside of it.
+func TestBase(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, "package policy\n\ndeny[msg] {\n\tinput.replicas < 2\n\tmsg := \"replicas\"\n}\n")
+	for _, test := range []struct {
+		base     string
+		file     string
+		expected string
+	}{
+		{dir, filepath.Join(dir, "nested", "deeper", "template.yml"), "nested/deeper/template.yml"},
+		{filepath.Join(dir, "nested"), filepath.Join(dir, "nested", "template.yml"), "template.yml"},
+		{filepath.Join(dir, "other"), filepath.Join(dir, "nested", "template.yml"), filepath.Join(dir, "nested", "template.yml")},
+		{filepath.Join(dir, "nested"), filepath.Join(dir, "nested-sibling", "template.yml"), filepath.Join(dir, "nested-sibling", "template.yml")},
+	} {
+		if err := os.MkdirAll(filepath.Dir(test.file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, test.file, "replicas: 1\n")
+		results, err := Infer(context.Background(), policy, test.file, Options{Base: test.base})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].File != test.expected || results[0].Locations[0].File != test.expected {
+			t.Errorf("base %s: reported %s at %s, expected %s",
+				test.base, results[0].File, results[0].Locations[0].File, test.expected)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("INFERATTRS_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// command runs the tool with arguments in a directory, and returns its exit
+// status, stdout and stderr.
+func command(t *testing.T, dir string, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "INFERATTRS_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), stdout.String(), stderr.String()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0, stdout.String(), stderr.String()
+}
+
+func TestCommand(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "checks.rego"), `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "run at least two replicas"
+}
+`)
+	writeFile(t, filepath.Join(dir, "warnings.rego"), `package policy
+
+warn[msg] {
+	endswith(input.spec.image, ":latest")
+	msg := "pin the image"
+}
+`)
+	writeFile(t, filepath.Join(dir, "failing.yml"), "spec:\n  replicas: 1\n  image: nginx:latest\n")
+	writeFile(t, filepath.Join(dir, "passing.yml"), "spec:\n  replicas: 3\n  image: nginx:1.25\n")
+
+	for _, test := range []struct {
+		name   string
+		stdin  string
+		args   []string
+		status int
+		stdout string
+		stderr string
+	}{
+		{
+			name:   "failing",
+			args:   []string{"-policy", "checks.rego", "-input", "failing.yml"},
+			status: 1,
+			stderr: "Location: failing.yml:2:13",
+		},
+		{
+			name:   "exit zero",
+			args:   []string{"-policy", "checks.rego", "-input", "failing.yml", "-exit-zero"},
+			stderr: "Finding (error): run at least two replicas",
+		},
+		{
+			name: "passing",
+			args: []string{"-policy", "checks.rego", "-input", "passing.yml"},
+		},
+		{
+			name:   "debug",
+			args:   []string{"-policy", "checks.rego", "-input", "passing.yml", "-debug"},
+			stderr: "Trace (passing.yml, document 0, data.policy.deny):\nEnter data.policy.deny",
+		},
+		{
+			// Warnings don't fail the run.
+			name:   "warnings",
+			args:   []string{"-policy", "warnings.rego", "-input", "failing.yml"},
+			stderr: "Finding (warning): pin the image",
+		},
+		{
+			// Listing reads doesn't fail the run.
+			name:   "reads",
+			args:   []string{"-policy", "checks.rego", "-input", "failing.yml", "-reads"},
+			stderr: "Reads (failing.yml, document 0): data.policy.deny\n  Location: failing.yml:2:13 spec.replicas = 1",
+		},
+		{
+			// The warning is left out, it comes later in the file.
+			name:   "max",
+			args:   []string{"-policy", "checks.rego", "-policy", "warnings.rego", "-input", "failing.yml", "-max", "1"},
+			status: 1,
+			stderr: "Location: failing.yml:2:13 spec.replicas = 1\n…and 1 more location\n",
+		},
+		{
+			name:   "stdin",
+			stdin:  "spec:\n  replicas: 0\n",
+			args:   []string{"-policy", "checks.rego", "-input", "-"},
+			status: 1,
+			stderr: "Location: <stdin>:2:13",
+		},
+		{
+			name:   "json",
+			args:   []string{"-policy", "checks.rego", "-input", "failing.yml", "-format", "json"},
+			status: 1,
+			stdout: `"message": "run at least two replicas"`,
+		},
+		{
+			name:   "sarif",
+			args:   []string{"-policy", "checks.rego", "-input", "failing.yml", "-format", "sarif"},
+			status: 1,
+			stdout: `"startLine": 2`,
+		},
+		{
+			name:   "missing policy",
+			args:   []string{"-input", "failing.yml"},
+			status: 2,
+			stderr: "policy.rego: no such file or directory",
+		},
+		{
+			name:   "unknown format",
+			args:   []string{"-policy", "checks.rego", "-input", "failing.yml", "-format", "xml"},
+			status: 2,
+			stderr: "unknown format: xml",
+		},
+		{
+			name:   "arguments",
+			args:   []string{"-policy", "checks.rego", "failing.yml"},
+			status: 2,
+			stderr: "Usage:",
+		},
+	} {
+		status, stdout, stderr := command(t, dir, test.stdin, test.args...)
+		if status != test.status {
+			t.Errorf("%s: exit status %d, expected %d:\n%s", test.name, status, test.status, stderr)
+		}
+		if !strings.Contains(stdout, test.stdout) {
+			t.Errorf("%s: expected %q on stdout, got:\n%s", test.name, test.stdout, stdout)
+		}
+		if !strings.Contains(stderr, test.stderr) {
+			t.Errorf("%s: expected %q on stderr, got:\n%s", test.name, test.stderr, stderr)
+		}
+		if test.stdout == "" && test.stderr == "" && stdout+stderr != "" {
+			t.Errorf("%s: expected no output, got:\n%s%s", test.name, stdout, stderr)
+		}
+	}
+}
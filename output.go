@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output formats supported by the -format flag.
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatSARIF = "sarif"
+	// FormatAnnotated shows the offending lines of the template, with a
+	// caret under the attributes, like compiler errors do.
+	FormatAnnotated = "annotated"
+	// FormatGitHub prints workflow commands, which GitHub Actions shows as
+	// annotations on the template.
+	FormatGitHub = "github"
+)
+
+// Values of the -color flag.
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// palette adds ANSI colors to the text and annotated formats.  The zero value
+// doesn't add anything, which is what the other formats always get.
+type palette struct {
+	enabled bool
+}
+
+// newPalette decides whether to color output written to a file.  In auto
+// mode we only do so for terminals, and respect https://no-color.org/.
+func newPalette(mode string, file *os.File) palette {
+	switch mode {
+	case ColorAlways:
+		return palette{enabled: true}
+	case ColorNever:
+		return palette{}
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return palette{}
+	}
+	info, err := file.Stat()
+	return palette{enabled: err == nil && info.Mode()&os.ModeCharDevice != 0}
+}
+
+func (p palette) paint(code string, text string) string {
+	if !p.enabled || text == "" {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// severity returns the color code for a severity.
+func (p palette) severity(severity string) string {
+	switch severity {
+	case SeverityError:
+		return "1;31"
+	case SeverityWarning:
+		return "1;33"
+	}
+	return "1;36"
+}
+
+// limit keeps the first n locations by file, line and column, across all
+// results, and returns how many were left out.  Findings are dropped once
+// all their locations are, and a finding without locations counts as one at
+// the start of its file, since it is still reported.  The results themselves
+// are not changed.
+func limit(results []*Result, n int) ([]*Result, int) {
+	// A location of a finding, or the finding itself if it has none.
+	type entry struct {
+		result, finding, location int
+		at                        Location
+	}
+	entries := []entry{}
+	for i, result := range results {
+		for j, finding := range result.Findings {
+			if len(finding.Locations) == 0 {
+				entries = append(entries, entry{i, j, -1, Location{File: result.File}})
+			}
+			for k, location := range finding.Locations {
+				entries = append(entries, entry{i, j, k, location})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].at, entries[j].at
+		if a.File != b.File {
+			return a.File < b.File
+		} else if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	omitted := 0
+	if len(entries) > n {
+		omitted = len(entries) - n
+		entries = entries[:n]
+	}
+	kept := map[[3]int]bool{}
+	for _, entry := range entries {
+		kept[[3]int{entry.result, entry.finding, entry.location}] = true
+	}
+
+	limited := []*Result{}
+	for i, result := range results {
+		truncated := *result
+		truncated.Findings, truncated.Locations = nil, []Location{}
+		for j, finding := range result.Findings {
+			if len(finding.Locations) == 0 {
+				if kept[[3]int{i, j, -1}] {
+					truncated.Findings = append(truncated.Findings, finding)
+				}
+				continue
+			}
+			locations := []Location{}
+			for k, location := range finding.Locations {
+				if kept[[3]int{i, j, k}] {
+					locations = append(locations, location)
+				}
+			}
+			if len(locations) > 0 {
+				finding.Locations = locations
+				truncated.Findings = append(truncated.Findings, finding)
+				truncated.Locations = append(truncated.Locations, locations...)
+			}
+		}
+		truncated.Locations = sortLocations(truncated.Locations)
+		limited = append(limited, &truncated)
+	}
+	return limited, omitted
+}
+
+func writeText(w io.Writer, results []*Result, colors palette) error {
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			fmt.Fprintf(w, "Finding (%s): %s\n",
+				colors.paint(colors.severity(finding.Severity), finding.Severity), finding.Message)
+			if result.Resource != nil {
+				fmt.Fprintf(w, "  Resource: %s\n", result.Resource)
+			}
+			if result.Description != "" {
+				fmt.Fprintf(w, "  Description: %s\n", shorten(result.Description))
+			}
+			for _, rule := range finding.Rules {
+				if rule.Title != "" {
+					fmt.Fprintf(w, "  Rule: %s (%s)\n", rule, rule.Title)
+				} else {
+					fmt.Fprintf(w, "  Rule: %s\n", rule)
+				}
+				if rule.Description != "" {
+					fmt.Fprintf(w, "    Description: %s\n", shorten(rule.Description))
+				}
+			}
+			for _, location := range finding.Locations {
+				position := colors.paint("36", location.String())
+				if location.Key {
+					fmt.Fprintf(w, "  Location: %s %s = %s (key)\n", position, location.ref(), location.Value)
+				} else {
+					fmt.Fprintf(w, "  Location: %s %s = %s\n", position, location.ref(), location.Value)
+				}
+				if location.Comment != "" {
+					fmt.Fprintf(w, "    Comment: %s\n", shorten(location.Comment))
+				}
+				for _, step := range location.Explanation {
+					fmt.Fprintf(w, "    Read by: %s\n", step)
+				}
+			}
+			for _, path := range finding.Unresolved {
+				fmt.Fprintf(w, "  Unresolved: %s\n", path)
+			}
+		}
+	}
+	return nil
+}
+
+func writeAnnotated(w io.Writer, results []*Result, colors palette) error {
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			highlight := colors.severity(finding.Severity)
+			fmt.Fprintf(w, "%s: %s\n", colors.paint(highlight, finding.Severity), finding.Message)
+			for _, location := range finding.Locations {
+				fmt.Fprintf(w, "  %s %s %s\n", colors.paint("34", "-->"), location.String(), location.ref())
+				if result.source == nil {
+					continue
+				}
+				text := result.source.line(location.Line)
+				if text == nil || location.Column > len(text)+1 {
+					continue
+				}
+				// Only the first line of multi-line values is shown.
+				end := location.EndColumn
+				if location.EndLine != location.Line || end > len(text)+1 {
+					end = len(text) + 1
+				}
+				start := expandTabs(text[:location.Column-1])
+				width := len(expandTabs(text[:end-1])) - len(start)
+				if width < 1 {
+					width = 1
+				}
+				expanded := expandTabs(text)
+				stop := len(start) + width
+				if stop > len(expanded) {
+					stop = len(expanded)
+				}
+				gutter := strconv.Itoa(location.Line)
+				margin := strings.Repeat(" ", len(gutter))
+				bar := colors.paint("34", "|")
+				fmt.Fprintf(w, "%s %s\n", margin, bar)
+				fmt.Fprintf(w, "%s %s %s%s%s\n", colors.paint("34", gutter), bar,
+					string(expanded[:len(start)]),
+					colors.paint(highlight, string(expanded[len(start):stop])),
+					string(expanded[stop:]))
+				fmt.Fprintf(w, "%s %s %s%s\n", margin, bar,
+					strings.Repeat(" ", len(start)), colors.paint(highlight, strings.Repeat("^", width)))
+				for _, step := range location.Explanation {
+					fmt.Fprintf(w, "%s = read by %s\n", margin, step)
+				}
+			}
+			for _, path := range finding.Unresolved {
+				fmt.Fprintf(w, "  %s %s (not found in %s)\n", colors.paint("34", "-->"), path, result.File)
+			}
+			if result.Resource != nil {
+				fmt.Fprintf(w, "  = resource %s\n", result.Resource)
+			}
+			for _, rule := range finding.Rules {
+				if rule.Title != "" {
+					fmt.Fprintf(w, "  = rule %s (%s)\n", rule, rule.Title)
+				} else {
+					fmt.Fprintf(w, "  = rule %s\n", rule)
+				}
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	return nil
+}
+
+// expandTabs replaces tabs by spaces up to the next multiple of 8, so the
+// carets line up with the text above them.
+func expandTabs(text []rune) []rune {
+	out := []rune{}
+	for _, r := range text {
+		if r == '\t' {
+			for len(out)%8 != 7 {
+				out = append(out, ' ')
+			}
+			r = ' '
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// writeGitHub prints a workflow command per location of each finding, see
+// https://docs.github.com/en/actions/using-workflows/workflow-commands-for-github-actions.
+func writeGitHub(w io.Writer, results []*Result) error {
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			command := "error"
+			switch finding.Severity {
+			case SeverityWarning:
+				command = "warning"
+			case SeverityInfo:
+				command = "notice"
+			}
+			message := githubEscape(finding.Message, false)
+			if len(finding.Locations) == 0 {
+				fmt.Fprintf(w, "::%s file=%s,title=%s::%s\n", command,
+					githubEscape(result.File, true), githubEscape(result.Query, true), message)
+				continue
+			}
+			for _, location := range finding.Locations {
+				fmt.Fprintf(w, "::%s file=%s,line=%d,col=%d,endLine=%d,endColumn=%d,title=%s::%s\n",
+					command, githubEscape(location.File, true),
+					location.Line, location.Column, location.EndLine, location.EndColumn,
+					githubEscape(location.ref(), true), message)
+			}
+		}
+	}
+	return nil
+}
+
+// githubEscape escapes the characters that would end a workflow command
+// early.  Properties are also delimited by `,` and `:`.
+func githubEscape(text string, property bool) string {
+	text = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(text)
+	if property {
+		text = strings.NewReplacer(":", "%3A", ",", "%2C").Replace(text)
+	}
+	return text
+}
+
+type jsonFinding struct {
+	Query       string                 `json:"query"`
+	Severity    string                 `json:"severity"`
+	Message     string                 `json:"message"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Document    int                    `json:"document"`
+	Description string                 `json:"description,omitempty"`
+	Resource    *Resource              `json:"resource,omitempty"`
+	Locations   []Location             `json:"locations"`
+	Rules       []Rule                 `json:"rules,omitempty"`
+}
+
+func writeJSON(w io.Writer, results []*Result) error {
+	findings := []jsonFinding{}
+	for _, result := range results {
+		for _, finding := range result.Findings {
+			findings = append(findings, jsonFinding{
+				Query:       result.Query,
+				Severity:    finding.Severity,
+				Message:     finding.Message,
+				Metadata:    finding.Metadata,
+				Document:    result.Document,
+				Description: result.Description,
+				Resource:    result.Resource,
+				Locations:   finding.Locations,
+				Rules:       finding.Rules,
+			})
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(findings)
+}
+
+// writeReads lists the attributes read by each query, see Options.Reads.
+func writeReads(w io.Writer, results []*Result, colors palette) error {
+	for _, result := range results {
+		fmt.Fprintf(w, "Reads (%s, document %d): %s\n", result.File, result.Document, result.Query)
+		for _, location := range result.Reads {
+			fmt.Fprintf(w, "  Location: %s %s = %s\n",
+				colors.paint("36", location.String()), location.ref(), location.Value)
+		}
+		for _, path := range result.Unresolved {
+			// There is no position, but it still helps to see e.g. a
+			// typo next to the attributes that were found.
+			fmt.Fprintf(w, "  Location: %s %s\n", colors.paint("36", result.File+":?"), path)
+		}
+	}
+	return nil
+}
+
+type jsonReads struct {
+	Query     string     `json:"query"`
+	File      string     `json:"file"`
+	Document  int        `json:"document"`
+	Locations []Location `json:"locations"`
+	// Paths that aren't in the source, see Result.Unresolved.
+	Unresolved []Path `json:"unresolved"`
+}
+
+func writeReadsJSON(w io.Writer, results []*Result) error {
+	reads := []jsonReads{}
+	for _, result := range results {
+		locations := result.Reads
+		if locations == nil {
+			locations = []Location{}
+		}
+		unresolved := result.Unresolved
+		if unresolved == nil {
+			unresolved = []Path{}
+		}
+		reads = append(reads, jsonReads{
+			Query:      result.Query,
+			File:       result.File,
+			Document:   result.Document,
+			Locations:  locations,
+			Unresolved: unresolved,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(reads)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestLimit caps the locations across the findings of several documents.
+func TestLimit(t *testing.T) {
+	locations := func(lines ...int) []Location {
+		out := []Location{}
+		for _, line := range lines {
+			out = append(out, Location{File: "template.yml", Line: line, Column: 1})
+		}
+		return out
+	}
+	results := []*Result{
+		{File: "template.yml", Findings: []Finding{
+			{Message: "a", Locations: locations(1, 2)},
+			{Message: "b", Locations: locations(3, 4, 5)},
+		}},
+		{File: "template.yml", Findings: []Finding{
+			{Message: "c"},
+			{Message: "d", Locations: locations(6)},
+		}},
+	}
+	results[0].Locations = locations(1, 2, 3, 4, 5)
+	results[1].Locations = locations(6)
+
+	for _, test := range []struct {
+		n        int
+		messages []string
+		counts   []int
+		omitted  int
+	}{
+		// The finding without locations is at the start of the file.
+		{1, []string{"c"}, []int{0}, 6},
+		{3, []string{"a", "c"}, []int{2, 0}, 4},
+		{6, []string{"a", "b", "c"}, []int{2, 3, 0}, 1},
+		{7, []string{"a", "b", "c", "d"}, []int{2, 3, 0, 1}, 0},
+		{100, []string{"a", "b", "c", "d"}, []int{2, 3, 0, 1}, 0},
+	} {
+		limited, omitted := limit(results, test.n)
+		messages, counts, total := []string{}, []int{}, 0
+		for _, result := range limited {
+			for _, finding := range result.Findings {
+				messages = append(messages, finding.Message)
+				counts = append(counts, len(finding.Locations))
+			}
+			total += len(result.Locations)
+		}
+		if omitted != test.omitted {
+			t.Errorf("limit(%d) omitted %d, expected %d", test.n, omitted, test.omitted)
+		}
+		if len(messages) != len(test.messages) {
+			t.Errorf("limit(%d) kept %v, expected %v", test.n, messages, test.messages)
+			continue
+		}
+		for i := range messages {
+			if messages[i] != test.messages[i] || counts[i] != test.counts[i] {
+				t.Errorf("limit(%d) kept %v with %v locations, expected %v with %v",
+					test.n, messages, counts, test.messages, test.counts)
+				break
+			}
+		}
+		sum := 0
+		for _, count := range counts {
+			sum += count
+		}
+		if total != sum {
+			t.Errorf("limit(%d) kept %d locations in Result.Locations, expected %d", test.n, total, sum)
+		}
+	}
+	if len(results[0].Findings[1].Locations) != 3 || len(results[0].Locations) != 5 {
+		t.Error("limit changed the results")
+	}
+}
+
+// TestLimitFiles checks that limit keeps the first locations by file and
+// line, not in the order the findings were reported.
+func TestLimitFiles(t *testing.T) {
+	results := []*Result{
+		{File: "b.yml", Findings: []Finding{
+			{Message: "b", Locations: []Location{{File: "b.yml", Line: 1, Column: 1}}},
+		}},
+		{File: "a.yml", Findings: []Finding{
+			{Message: "a", Locations: []Location{
+				{File: "a.yml", Line: 9, Column: 1},
+				{File: "a.yml", Line: 2, Column: 5},
+			}},
+		}},
+	}
+	limited, omitted := limit(results, 2)
+	if omitted != 1 || len(limited) != 2 || len(limited[0].Findings) != 0 || len(limited[1].Findings) != 1 {
+		t.Fatalf("expected only the locations in a.yml, omitted %d", omitted)
+	}
+	if found := limited[1].Findings[0].Locations; len(found) != 2 || found[0].Line != 9 || found[1].Line != 2 {
+		t.Errorf("unexpected locations %v", found)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "too few replicas"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "spec:\n  replicas: 1\n")
+	results, err := Infer(context.Background(), policy, template, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := writeJSON(&buffer, results); err != nil {
+		t.Fatal(err)
+	}
+	var findings []struct {
+		Message   string `json:"message"`
+		Document  int    `json:"document"`
+		Locations []struct {
+			File    string   `json:"file"`
+			Line    int      `json:"line"`
+			Column  int      `json:"column"`
+			Path    []string `json:"path"`
+			Pointer string   `json:"pointer"`
+			Rego    string   `json:"rego"`
+		} `json:"locations"`
+	}
+	if err := json.Unmarshal(buffer.Bytes(), &findings); err != nil {
+		t.Fatalf("%s:\n%s", err, buffer.String())
+	}
+	if len(findings) != 1 || findings[0].Message != "too few replicas" || findings[0].Document != 0 {
+		t.Fatalf("unexpected findings:\n%s", buffer.String())
+	}
+	location := findings[0].Locations[0]
+	if len(findings[0].Locations) != 1 || location.File != template || location.Line != 2 || location.Column != 13 {
+		t.Errorf("unexpected locations:\n%s", buffer.String())
+	} else if !reflect.DeepEqual(location.Path, []string{"spec", "replicas"}) ||
+		location.Pointer != "/spec/replicas" || location.Rego != "input.spec.replicas" {
+		t.Errorf("unexpected path %v, %s, %s", location.Path, location.Pointer, location.Rego)
+	}
+}
+
+// TestWriteReads checks that reads list the attributes that aren't in the
+// template, e.g. typos.
+func TestWriteReads(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.metadata.nmae == "web"
+	input.spec.replicas < 2
+	msg := "too few replicas"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "metadata:\n  name: web\nspec:\n  replicas: 1\n")
+	results, err := Infer(context.Background(), policy, template, Options{NoEval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	if err := writeReads(&buffer, results, palette{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("Reads (%[1]s, document 0): static\n"+
+		"  Location: %[1]s:4:13 spec.replicas = 1\n"+
+		"  Location: %[1]s:? metadata.nmae\n", template); buffer.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", buffer.String(), expected)
+	}
+
+	buffer.Reset()
+	if err := writeReadsJSON(&buffer, results); err != nil {
+		t.Fatal(err)
+	}
+	var reads []struct {
+		Locations  []Location `json:"locations"`
+		Unresolved [][]string `json:"unresolved"`
+	}
+	if err := json.Unmarshal(buffer.Bytes(), &reads); err != nil {
+		t.Fatalf("%s:\n%s", err, buffer.String())
+	}
+	if len(reads) != 1 || len(reads[0].Locations) != 1 ||
+		!reflect.DeepEqual(reads[0].Unresolved, [][]string{{"metadata", "nmae"}}) {
+		t.Errorf("unexpected reads:\n%s", buffer.String())
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.rego")
+	writeFile(t, policy, `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "run at least two replicas"
+}
+
+info[msg] {
+	msg := "no attributes"
+}
+`)
+	template := filepath.Join(dir, "template.yml")
+	writeFile(t, template, "kind: Deployment\nspec:\n  replicas: 1\n")
+	results, err := Infer(context.Background(), policy, template, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	if err := writeSARIF(&output, results); err != nil {
+		t.Fatal(err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(output.Bytes(), &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.Version != "2.1.0" || !strings.Contains(log.Schema, "sarif-2.1.0") || len(log.Runs) != 1 {
+		t.Fatalf("unexpected SARIF log: %s", output.String())
+	}
+	run := log.Runs[0]
+	if run.Tool.Driver.Name != "inferattrs" || run.ColumnKind != "unicodeCodePoints" {
+		t.Errorf("unexpected tool %+v and column kind %q", run.Tool.Driver, run.ColumnKind)
+	}
+	rules := map[string]bool{}
+	for _, rule := range run.Tool.Driver.Rules {
+		rules[rule.ID] = true
+	}
+	if len(run.Results) != 2 {
+		t.Fatalf("expected two results: %s", output.String())
+	}
+	// Findings without attributes are still in the file, but there is no
+	// region to point to.
+	if result := run.Results[1]; len(result.Locations) != 1 ||
+		result.Locations[0].PhysicalLocation.ArtifactLocation.URI != template ||
+		result.Locations[0].PhysicalLocation.Region != nil {
+		t.Errorf("unexpected locations for %s: %+v", result.RuleID, result.Locations)
+	}
+	result := run.Results[0]
+	if result.RuleID != "policy.deny" || !rules[result.RuleID] {
+		t.Errorf("result refers to rule %q, declared are %v", result.RuleID, rules)
+	}
+	if result.Level != "error" || result.Message.Text != "run at least two replicas" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(result.Locations) != 1 {
+		t.Fatalf("expected a single location: %s", output.String())
+	}
+	physical := result.Locations[0].PhysicalLocation
+	if physical.ArtifactLocation.URI != template {
+		t.Errorf("result is in %s", physical.ArtifactLocation.URI)
+	}
+	if physical.Region.StartLine != 3 || physical.Region.StartColumn != 13 {
+		t.Errorf("unexpected region %+v", physical.Region)
+	}
+	if logical := result.Locations[0].LogicalLocations; len(logical) != 1 ||
+		logical[0].FullyQualifiedName != "spec.replicas" {
+		t.Errorf("unexpected logical locations %+v", logical)
+	}
+}
+
+func TestWriteGitHub(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input.spec["a,b"] == "x"
+	msg := "100% wrong\nreally"
+}
+
+warn[msg] {
+	msg := "no attributes"
+}
+`, "template.yml", "spec:\n  \"a,b\": x\n", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	if err := writeGitHub(&output, results); err != nil {
+		t.Fatal(err)
+	}
+	expected := "::error file=template.yml,line=2,col=10,endLine=2,endColumn=11,title=spec[\"a%2Cb\"]::100%25 wrong%0Areally\n" +
+		"::warning file=template.yml,title=data.policy.warn::no attributes\n"
+	if output.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", output.String(), expected)
+	}
+}
+
+// TestColor checks that text output only has escape codes for terminals.
+func TestColor(t *testing.T) {
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input.name == "web"
+	msg := "web"
+}
+`, "template.yml", "name: web\n", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(t.TempDir(), "output.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, test := range []struct {
+		mode    string
+		escapes bool
+	}{
+		{ColorAuto, false},
+		{ColorNever, false},
+		{ColorAlways, true},
+	} {
+		for _, write := range []func(*bytes.Buffer, palette) error{
+			func(w *bytes.Buffer, colors palette) error { return writeText(w, results, colors) },
+			func(w *bytes.Buffer, colors palette) error { return writeAnnotated(w, results, colors) },
+		} {
+			var output bytes.Buffer
+			if err := write(&output, newPalette(test.mode, file)); err != nil {
+				t.Fatal(err)
+			}
+			if escapes := strings.Contains(output.String(), "\x1b["); escapes != test.escapes {
+				t.Errorf("-color %s: escape codes = %t, expected %t:\n%q", test.mode, escapes, test.escapes, output.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// action matches the template expressions that Options.Templated replaces:
+// Go template actions, as used by Helm, and Jinja expressions, statements and
+// comments.
+var action = regexp.MustCompile(`(?s)\{\{.*?\}\}|\{%.*?%\}|\{#.*?#\}`)
+
+// placeholder is a run of `_` that replaced (part of) a template action.  It
+// never spans multiple lines.
+type placeholder struct {
+	line      int
+	column    int
+	endColumn int
+}
+
+// stripActions replaces template actions by text of the same length, so
+// positions in the result are the same as in the template.  Lines that only
+// hold actions, like `{{- if .Values.enabled }}`, are blanked out.  Other
+// actions become `_`s, so `image: {{ .Values.image }}` still parses as a
+// plain scalar.  It returns the byte ranges of those `_`s.
+func stripActions(data []byte) ([]byte, [][2]int) {
+	const marker = 0
+	stripped := append([]byte{}, data...)
+	for _, match := range action.FindAllIndex(data, -1) {
+		for i := match[0]; i < match[1]; i++ {
+			if stripped[i] != '\n' {
+				stripped[i] = marker
+			}
+		}
+	}
+
+	ranges := [][2]int{}
+	for start := 0; start < len(stripped); {
+		end := bytes.IndexByte(stripped[start:], '\n')
+		if end < 0 {
+			end = len(stripped)
+		} else {
+			end += start
+		}
+		line := stripped[start:end]
+		if bytes.IndexByte(line, marker) >= 0 {
+			if len(bytes.Trim(line, " \t\r\x00")) == 0 {
+				for i := range line {
+					if line[i] == marker {
+						line[i] = ' '
+					}
+				}
+			} else {
+				for i := 0; i < len(line); i++ {
+					if line[i] != marker {
+						continue
+					}
+					j := i
+					for ; j < len(line) && line[j] == marker; j++ {
+						line[j] = '_'
+					}
+					ranges = append(ranges, [2]int{start + i, start + j})
+					i = j
+				}
+			}
+		}
+		start = end + 1
+	}
+	return stripped, ranges
+}
+
+// markSynthetic records the scalars that contain a placeholder.  Their end
+// positions are computed from the stripped text, since the template text
+// doesn't match their value.
+func (source *Source) markSynthetic(stripped [][]rune, ranges [][2]int) {
+	placeholders := []placeholder{}
+	for _, r := range ranges {
+		line, column := source.position(r[0])
+		_, endColumn := source.position(r[1])
+		placeholders = append(placeholders, placeholder{line, column, endColumn})
+	}
+
+	parsed := *source
+	parsed.lines = stripped
+	var walk func(node *yaml.Node)
+	walk = func(node *yaml.Node) {
+		for _, child := range node.Content {
+			walk(child)
+		}
+		if node.Kind != yaml.ScalarNode {
+			return
+		}
+		endLine, endColumn := parsed.end(node)
+		for _, p := range placeholders {
+			if before(node.Line, node.Column, p.line, p.endColumn) &&
+				before(p.line, p.column, endLine, endColumn) {
+				source.ends[node] = [2]int{endLine, endColumn}
+				source.synthetic[node] = true
+				return
+			}
+		}
+	}
+	for _, doc := range source.docs {
+		walk(doc)
+	}
+}
+
+// before compares two positions.
+func before(line int, column int, otherLine int, otherColumn int) bool {
+	return line < otherLine || line == otherLine && column < otherColumn
+}
+
+// text returns the source text between two positions, with newlines.
+func (source *Source) text(line int, column int, endLine int, endColumn int) string {
+	var builder strings.Builder
+	for l := line; l <= endLine; l++ {
+		text := source.line(l)
+		start, end := 0, len(text)
+		if l == line {
+			start = column - 1
+		}
+		if l == endLine && endColumn-1 < end {
+			end = endColumn - 1
+		}
+		if start < end {
+			builder.WriteString(string(text[start:end]))
+		}
+		if l < endLine {
+			builder.WriteString("\n")
+		}
+	}
+	return builder.String()
+}
+
+// synthetic checks whether a finding depends on a placeholder.  The template
+// decides the actual value, so the finding may well be wrong.
+func synthetic(finding *Finding) bool {
+	for _, location := range finding.Locations {
+		if location.Synthetic {
+			return true
+		}
+	}
+	return false
+}
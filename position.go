@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// end computes the (exclusive) end position of a node.  yaml.v3 only tracks
+// where nodes start, so we need to look at the source text for this.  Lines
+// and columns are 1-based and count characters, like yaml.v3 does.
+func (source *Source) end(node *yaml.Node) (int, int) {
+	if end, ok := source.ends[node]; ok {
+		return end[0], end[1]
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) > 0 {
+			return source.end(node.Content[0])
+		}
+	case yaml.AliasNode:
+		return node.Line, node.Column + 1 + len([]rune(node.Value))
+	case yaml.ScalarNode:
+		switch node.Style {
+		case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+			return source.endQuoted(node)
+		case yaml.LiteralStyle, yaml.FoldedStyle:
+			return source.endBlock(node)
+		default:
+			return source.endPlain(node)
+		}
+	case yaml.MappingNode, yaml.SequenceNode:
+		line, column := node.Line, node.Column+1
+		if len(node.Content) > 0 {
+			line, column = source.end(node.Content[len(node.Content)-1])
+		}
+		if node.Style&yaml.FlowStyle != 0 {
+			// Include the closing bracket.
+			return source.scanFor(line, column, "]}")
+		}
+		return line, column
+	}
+	return node.Line, node.Column
+}
+
+// skipProperties moves nodes with an anchor or an explicit tag, such as
+// `&port !!int 80`, to their value.  yaml.v3 points to the first property
+// instead, which would put their locations and end positions off.  The
+// TaggedStyle flag is dropped as well, so the style is the one of the value.
+func (source *Source) skipProperties(node *yaml.Node) {
+	if node.Kind != yaml.AliasNode && (node.Anchor != "" || node.Style&yaml.TaggedStyle != 0) {
+		node.Line, node.Column = source.afterProperties(node)
+		node.Style &^= yaml.TaggedStyle
+	}
+	for _, child := range node.Content {
+		source.skipProperties(child)
+	}
+}
+
+// afterProperties finds the start of the value of a node after its anchor and
+// tag.  Block collections and scalars written on the next line start there,
+// but an empty scalar stays right after its properties.
+func (source *Source) afterProperties(node *yaml.Node) (int, int) {
+	line, column := node.Line, node.Column
+	lastLine, lastColumn := line, column
+	for line <= len(source.lines) {
+		text := source.line(line)
+		for column <= len(text) && (text[column-1] == ' ' || text[column-1] == '\t') {
+			column++
+		}
+		if column > len(text) || text[column-1] == '#' {
+			if node.Kind == yaml.ScalarNode && node.Value == "" {
+				break
+			}
+			line, column = line+1, 1
+			continue
+		} else if text[column-1] != '&' && text[column-1] != '!' {
+			return line, column
+		}
+		for column <= len(text) && !strings.ContainsRune(" \t,]}", text[column-1]) {
+			column++
+		}
+		lastLine, lastColumn = line, column
+	}
+	return lastLine, lastColumn
+}
+
+// position converts a byte offset in the source to a line and column.
+func (source *Source) position(offset int) (int, int) {
+	lead := source.bytes[:offset]
+	line := bytes.Count(lead, []byte{'\n'}) + 1
+	column := utf8.RuneCount(lead[bytes.LastIndexByte(lead, '\n')+1:]) + 1
+	return line, column
+}
+
+// line returns a 1-based line, or nil if it is out of bounds.
+func (source *Source) line(line int) []rune {
+	if line < 1 || line > len(source.lines) {
+		return nil
+	}
+	return source.lines[line-1]
+}
+
+// Lines returns the text of the source by line, e.g. to quote a location.
+// They are numbered from 1 like yaml.Node.Line, so line n is Lines()[n-1].
+// With Options.Templated, this is the template text rather than what was
+// parsed.  The lines are built on the first call, which must not race with
+// other calls.
+func (source *Source) Lines() []Line {
+	if source.numbered == nil {
+		lines := source.lines
+		if n := len(lines); n > 0 && len(lines[n-1]) == 0 {
+			// The newline at the end of the file doesn't start a line.
+			lines = lines[:n-1]
+		}
+		source.numbered = make([]Line, len(lines))
+		for i, line := range lines {
+			source.numbered[i] = Line{Number: i + 1, Text: string(line)}
+		}
+	}
+	return source.numbered
+}
+
+// scanFor looks for the first of the given characters at or after a position,
+// and returns the position right after it.
+func (source *Source) scanFor(line int, column int, chars string) (int, int) {
+	for l := line; l <= len(source.lines); l++ {
+		text := source.line(l)
+		start := 0
+		if l == line {
+			start = column - 1
+		}
+		for i := start; i < len(text); i++ {
+			if strings.ContainsRune(chars, text[i]) {
+				return l, i + 2
+			}
+		}
+	}
+	return line, column
+}
+
+// quoted checks whether a node is a single- or double-quoted scalar.
+func quoted(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode &&
+		(node.Style == yaml.DoubleQuotedStyle || node.Style == yaml.SingleQuotedStyle)
+}
+
+func (source *Source) endQuoted(node *yaml.Node) (int, int) {
+	quote := '"'
+	if node.Style == yaml.SingleQuotedStyle {
+		quote = '\''
+	}
+	for l := node.Line; l <= len(source.lines); l++ {
+		text := source.line(l)
+		start := 0
+		if l == node.Line {
+			start = node.Column // Skip the opening quote.
+		}
+		for i := start; i < len(text); i++ {
+			switch {
+			case quote == '"' && text[i] == '\\':
+				i++ // Skip escaped character.
+			case text[i] == quote && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+				i++ // Skip escaped quote.
+			case text[i] == quote:
+				return l, i + 2
+			}
+		}
+	}
+	return node.Line, node.Column
+}
+
+// endBlock finds the last line of a literal or folded block scalar.  The
+// content of the block is everything indented at least as much as its first
+// non-empty line.
+func (source *Source) endBlock(node *yaml.Node) (int, int) {
+	line, column := node.Line, node.Column+1
+	indent := -1
+	for l := node.Line + 1; l <= len(source.lines); l++ {
+		text := source.line(l)
+		trimmed := strings.TrimLeft(string(text), " ")
+		if strings.TrimSpace(trimmed) == "" {
+			continue
+		}
+		current := len(text) - len([]rune(trimmed))
+		if indent < 0 {
+			indent = current
+		}
+		if current < indent || node.Value == "" {
+			break
+		}
+		line, column = l, len([]rune(strings.TrimRight(string(text), " \t\r")))+1
+	}
+	return line, column
+}
+
+// startBlock finds the start of the content of a literal or folded block
+// scalar, which is on the line after the `|` or `>` indicator.  If the block
+// is empty, the indicator is returned.
+func (source *Source) startBlock(node *yaml.Node) (int, int) {
+	if node.Value == "" {
+		return node.Line, node.Column
+	}
+	for l := node.Line + 1; l <= len(source.lines); l++ {
+		text := string(source.line(l))
+		if trimmed := strings.TrimLeft(text, " "); strings.TrimSpace(trimmed) != "" {
+			return l, len([]rune(text)) - len([]rune(trimmed)) + 1
+		}
+	}
+	return node.Line, node.Column
+}
+
+// endPlain handles plain scalars, which may be folded over multiple lines.
+// In that case the lines are joined by spaces in the value.
+func (source *Source) endPlain(node *yaml.Node) (int, int) {
+	value := []rune(node.Value)
+	text := source.line(node.Line)
+	if node.Column-1 > len(text) {
+		return node.Line, node.Column + len(value)
+	}
+	text = text[node.Column-1:]
+	for l := node.Line; ; {
+		segment := strings.TrimRight(string(text), " \t\r")
+		segmentRunes := []rune(segment)
+		if !strings.HasPrefix(string(value), segment) || len(segmentRunes) == 0 {
+			break
+		}
+		value = []rune(strings.TrimLeft(string(value[len(segmentRunes):]), " \n"))
+		if len(value) == 0 {
+			return l, len(source.line(l)) - len(text) + len(segmentRunes) + 1
+		}
+		if l++; l > len(source.lines) {
+			break
+		}
+		text = []rune(strings.TrimLeft(string(source.line(l)), " \t"))
+	}
+	return node.Line, node.Column + len([]rune(node.Value))
+}
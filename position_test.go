@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// span renders the start and end of a location, without the file.
+func span(location *Location) string {
+	if location == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%d:%d-%d:%d", location.Line, location.Column, location.EndLine, location.EndColumn)
+}
+
+func TestEnd(t *testing.T) {
+	source := testSource(t, "template.yml", `plain: hello world
+quoted: "a \" b"
+single: 'it''s'
+flow: [1, {a: 2}]
+block:
+  a: 1
+  b: [x, y]
+`)
+	for _, test := range []struct {
+		path Path
+		span string
+	}{
+		{Path{"plain"}, "1:8-1:19"},
+		// Quotes are left out.
+		{Path{"quoted"}, "2:10-2:16"},
+		{Path{"single"}, "3:10-3:15"},
+		// Flow collections include their closing bracket.
+		{Path{"flow"}, "4:7-4:18"},
+		{Path{"flow", "1"}, "4:11-4:17"},
+		{Path{"block"}, "6:3-7:12"},
+	} {
+		if s := span(source.Location(0, test.path)); s != test.span {
+			t.Errorf("Location(%s) = %s, expected %s", test.path, s, test.span)
+		}
+	}
+}
+
+func TestBlockScalars(t *testing.T) {
+	source := testSource(t, "template.yml", `script: |
+  echo hello
+  echo world
+folded: >-
+  a long
+  sentence
+empty: |
+next: 1
+`)
+	for _, test := range []struct {
+		path Path
+		span string
+	}{
+		// The content starts on the line after the indicator, and ends at
+		// its last line.
+		{Path{"script"}, "2:3-3:13"},
+		{Path{"folded"}, "5:3-6:11"},
+		{Path{"empty"}, "7:8-7:9"},
+		{Path{"next"}, "8:7-8:8"},
+	} {
+		if s := span(source.Location(0, test.path)); s != test.span {
+			t.Errorf("Location(%s) = %s, expected %s", test.path, s, test.span)
+		}
+	}
+}
+
+// TestProperties checks that anchors and tags are skipped, so locations point
+// to the value like they would without them.
+func TestProperties(t *testing.T) {
+	source := testSource(t, "template.yml", `a: &x 80
+b: *x
+c: &y !!str 90
+d: !!str "q"
+e: !!str |
+  block
+g: &m {k: 1}
+h: !!binary |
+  Y3VybA==
+i: &meta
+  name: web
+k: !!str
+l: 1
+`)
+	for _, test := range []struct {
+		path Path
+		span string
+	}{
+		{Path{"a"}, "1:7-1:9"},
+		{Path{"c"}, "3:13-3:15"},
+		{Path{"d"}, "4:11-4:12"},
+		{Path{"e"}, "6:3-6:8"},
+		{Path{"g", "k"}, "7:11-7:12"},
+		{Path{"h"}, "9:3-9:11"},
+		{Path{"i", "name"}, "11:9-11:12"},
+		{Path{"k"}, "12:9-12:9"},
+		{Path{"l"}, "13:4-13:5"},
+	} {
+		if s := span(source.Location(0, test.path)); s != test.span {
+			t.Errorf("Location(%s) = %s, expected %s", test.path, s, test.span)
+		}
+	}
+}
+
+// TestQuotedKeys checks that key locations leave out quotes, like values.
+func TestQuotedKeys(t *testing.T) {
+	source := testSource(t, "template.yml", `"double": 1
+'single': 2
+plain: 3
+"": 4
+`)
+	for _, test := range []struct {
+		path Path
+		span string
+	}{
+		{Path{"double"}, "1:2-1:8"},
+		{Path{"single"}, "2:2-2:8"},
+		{Path{"plain"}, "3:1-3:6"},
+		// An empty key is an empty range between its quotes.
+		{Path{""}, "4:2-4:2"},
+	} {
+		if s := span(source.KeyLocation(0, test.path)); s != test.span {
+			t.Errorf("KeyLocation(%s) = %s, expected %s", test.path, s, test.span)
+		}
+	}
+}
+
+// TestCRLF checks that a template with CRLF line endings gives the same
+// locations as with LF.
+func TestCRLF(t *testing.T) {
+	text := `name: web
+quoted: "a value"
+script: |
+  echo hello
+list: [1, 2]
+plain: a
+  folded value
+`
+	lf := testSource(t, "lf.yml", text)
+	crlf := testSource(t, "crlf.yml", strings.ReplaceAll(text, "\n", "\r\n"))
+	for _, path := range []Path{
+		{"name"}, {"quoted"}, {"script"}, {"list"}, {"list", "1"}, {"plain"},
+	} {
+		a, b := lf.Location(0, path), crlf.Location(0, path)
+		if span(a) != span(b) || a.Value != b.Value {
+			t.Errorf("Location(%s) = %s %q with LF, but %s %q with CRLF", path, span(a), a.Value, span(b), b.Value)
+		}
+	}
+	for line := 1; line <= 7; line++ {
+		if a, b := string(lf.line(line)), string(crlf.line(line)); a != b {
+			t.Errorf("line %d is %q with LF, but %q with CRLF", line, a, b)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	for _, test := range []struct {
+		text  string
+		lines []Line
+	}{
+		{"a: 1\nb: 2\n", []Line{{1, "a: 1"}, {2, "b: 2"}}},
+		{"a: 1\nb: 2", []Line{{1, "a: 1"}, {2, "b: 2"}}},
+		{"a: 1\n\n", []Line{{1, "a: 1"}, {2, ""}}},
+	} {
+		source := testSource(t, "template.yml", test.text)
+		if lines := source.Lines(); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("Lines(%q) = %v, expected %v", test.text, lines, test.lines)
+		}
+	}
+
+	// The line of a location, which comes from yaml.Node.Line, indexes
+	// the lines from 1.
+	source := testSource(t, "template.yml", "# web\nspec:\n  replicas: 3\n  image: nginx\n")
+	for _, path := range []Path{{"spec", "replicas"}, {"spec", "image"}} {
+		location := source.Location(0, path)
+		line := source.Lines()[location.Line-1]
+		if line.Number != location.Line || !strings.Contains(line.Text, location.Value) {
+			t.Errorf("Location(%s) is on line %d, but Lines() has %v there", path, location.Line, line)
+		}
+	}
+}
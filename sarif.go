@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// A minimal subset of SARIF 2.1.0, enough for code scanning integrations.
+// See <https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html>.
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool sarifTool `json:"tool"`
+	// SARIF counts columns in UTF-16 code units by default, ours are code
+	// points, see Location.
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string        `json:"id"`
+	ShortDescription *sarifMessage `json:"shortDescription,omitempty"`
+	FullDescription  *sarifMessage `json:"fullDescription,omitempty"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifLogicalLocation struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+// sarifLevel maps a severity to a SARIF level.
+func sarifLevel(severity string) string {
+	switch severity {
+	case SeverityWarning:
+		return "warning"
+	case SeverityInfo:
+		return "note"
+	}
+	return "error"
+}
+
+// sarifRuleID derives a rule ID from the query, e.g. "policy.deny" for
+// "data.policy.deny".
+func sarifRuleID(query string) string {
+	return strings.TrimPrefix(query, "data.")
+}
+
+func writeSARIF(w io.Writer, results []*Result) error {
+	run := sarifRun{
+		Tool: sarifTool{
+			Driver: sarifDriver{Name: "inferattrs", Rules: []sarifRule{}},
+		},
+		ColumnKind: "unicodeCodePoints",
+		Results:    []sarifResult{},
+	}
+	rules := map[string]int{}
+	for _, result := range results {
+		ruleID := sarifRuleID(result.Query)
+		if _, ok := rules[ruleID]; !ok {
+			rules[ruleID] = len(run.Tool.Driver.Rules)
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: ruleID})
+		}
+
+		for _, finding := range result.Findings {
+			// SARIF rules are our queries, they are described by the
+			// first annotated rule that produces a finding for them.
+			rule := &run.Tool.Driver.Rules[rules[ruleID]]
+			for _, r := range finding.Rules {
+				if rule.ShortDescription != nil || r.Title == "" {
+					continue
+				}
+				rule.ShortDescription = &sarifMessage{Text: r.Title}
+				if r.Description != "" {
+					rule.FullDescription = &sarifMessage{Text: r.Description}
+				}
+			}
+			locations := []sarifLocation{}
+			for _, location := range finding.Locations {
+				locations = append(locations, sarifLocation{
+					PhysicalLocation: sarifPhysicalLocation{
+						ArtifactLocation: sarifArtifactLocation{URI: location.File},
+						Region: &sarifRegion{
+							StartLine:   location.Line,
+							StartColumn: location.Column,
+							EndLine:     location.EndLine,
+							EndColumn:   location.EndColumn,
+						},
+					},
+					LogicalLocations: []sarifLogicalLocation{
+						{FullyQualifiedName: location.ref()},
+					},
+				})
+			}
+			if len(locations) == 0 {
+				// Findings that don't depend on any attribute still
+				// belong to the file, code scanning needs a location.
+				locations = append(locations, sarifLocation{
+					PhysicalLocation: sarifPhysicalLocation{
+						ArtifactLocation: sarifArtifactLocation{URI: result.File},
+					},
+				})
+			}
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    ruleID,
+				Level:     sarifLevel(finding.Severity),
+				Message:   sarifMessage{Text: finding.Message},
+				Locations: locations,
+			})
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is a JSON Schema for templates, used to find attributes that the
+// policy reads but that the schema doesn't define, which are usually typos.
+// Only the parts that describe the structure are used: `properties`,
+// `patternProperties`, `additionalProperties`, `items`, `prefixItems`,
+// `allOf`, `anyOf`, `oneOf` and local `$ref`s.  An object that lists
+// properties doesn't allow others, unless `additionalProperties` says so
+// explicitly, since that is what catches typos.
+type Schema map[string]interface{}
+
+// LoadSchema reads a JSON Schema from a JSON or YAML file.
+func LoadSchema(file string) (Schema, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, &ReadError{File: file, Err: err}
+	}
+	// Not a Schema, yaml.v3 would decode nested objects to that type too.
+	schema := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &schema); err != nil {
+		return nil, &ParseError{File: file, Err: err}
+	}
+	return schema, nil
+}
+
+// SchemaQuery is the query of the Result that reports attributes missing from
+// the schema, see Options.Schema.
+const SchemaQuery = "schema"
+
+// Unknown returns the shortest prefix of a path that the schema doesn't
+// allow, or nil if it allows the whole path.
+func (schema Schema) Unknown(path Path) Path {
+	nodes := []map[string]interface{}{schema}
+	for i, component := range path {
+		next := []map[string]interface{}{}
+		open := false
+		for _, node := range nodes {
+			children, ok := schema.step(node, component, 0)
+			open = open || ok && children == nil
+			next = append(next, children...)
+		}
+		if open {
+			// Something below here is not described, anything goes.
+			return nil
+		} else if len(next) == 0 {
+			return path[:i+1]
+		}
+		nodes = next
+	}
+	return nil
+}
+
+// step returns the schemas for a component below a schema.  The boolean
+// reports whether the component is allowed; it is allowed without schemas
+// when the schema doesn't constrain it.
+func (schema Schema) step(node map[string]interface{}, component string, depth int) ([]map[string]interface{}, bool) {
+	if depth > 32 {
+		// A `$ref` cycle, give up on this branch.
+		return nil, true
+	}
+	if ref, ok := node["$ref"].(string); ok {
+		target, ok := schema.resolve(ref)
+		if !ok {
+			return nil, true
+		}
+		return schema.step(target, component, depth+1)
+	}
+
+	found := []map[string]interface{}{}
+	constrained, allowed := false, false
+	add := func(value interface{}) {
+		allowed = true
+		if child, ok := value.(map[string]interface{}); ok {
+			found = append(found, child)
+		} else if value != true {
+			// E.g. `false`: nothing could be there.
+			allowed = false
+		}
+	}
+
+	if properties, ok := node["properties"].(map[string]interface{}); ok {
+		constrained = true
+		if child, ok := properties[component]; ok {
+			add(child)
+		}
+	}
+	if patterns, ok := node["patternProperties"].(map[string]interface{}); ok {
+		constrained = true
+		for pattern, child := range patterns {
+			if re, err := regexp.Compile(pattern); err == nil && re.MatchString(component) {
+				add(child)
+			}
+		}
+	}
+	if additional, ok := node["additionalProperties"]; ok && !allowed {
+		constrained = true
+		if additional != false {
+			add(additional)
+		}
+	}
+
+	if i, err := strconv.Atoi(component); err == nil && i >= 0 {
+		if prefix, ok := node["prefixItems"].([]interface{}); ok {
+			constrained = true
+			if i < len(prefix) {
+				add(prefix[i])
+			}
+		}
+		switch items := node["items"].(type) {
+		case []interface{}:
+			// The older tuple form of prefixItems.
+			constrained = true
+			if i < len(items) {
+				add(items[i])
+			}
+		case map[string]interface{}, bool:
+			constrained = true
+			if !allowed {
+				add(items)
+			}
+		}
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		alternatives, _ := node[keyword].([]interface{})
+		for _, alternative := range alternatives {
+			alternative, ok := alternative.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			children, ok := schema.step(alternative, component, depth+1)
+			if ok && children == nil {
+				return nil, true
+			}
+			constrained = true
+			found = append(found, children...)
+			allowed = allowed || ok
+		}
+	}
+
+	if !constrained {
+		return nil, true
+	} else if allowed && len(found) == 0 {
+		return nil, true
+	}
+	return found, allowed
+}
+
+// resolve finds the target of a local `$ref`, e.g. `#/$defs/container`.
+func (schema Schema) resolve(ref string) (map[string]interface{}, bool) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+	var node interface{} = map[string]interface{}(schema)
+	for _, token := range strings.Split(strings.TrimPrefix(ref[1:], "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch value := node.(type) {
+		case map[string]interface{}:
+			node = value[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(value) {
+				return nil, false
+			}
+			node = value[i]
+		default:
+			return nil, false
+		}
+	}
+	target, ok := node.(map[string]interface{})
+	return target, ok
+}
+
+// inputRefs finds the references to the input in a policy, e.g.
+// `input.spec.replicas`.  Rules that index on an attribute aren't evaluated
+// at all when the input doesn't have it, so these don't always show up in the
+// trace.  The paths are relative to the document, references that don't go
+// through the keys it is wrapped in are left out, see Options.Wrap.
+func inputRefs(modules map[string]*ast.Module, wrap Path) []Path {
+	tree := PathTree{}
+	for _, module := range modules {
+		ast.WalkRefs(module, func(ref ast.Ref) bool {
+			if !ref[0].Equal(ast.InputRootDocument) {
+				return false
+			}
+			path := Path{}
+			for _, key := range ref[1:] {
+				if str, ok := key.Value.(ast.String); ok {
+					path = append(path, string(str))
+				} else if number, ok := key.Value.(ast.Number); ok {
+					path = append(path, number.String())
+				} else {
+					break
+				}
+			}
+			if len(path) < len(wrap) || comparePaths(path[:len(wrap)], wrap) != 0 {
+				return false
+			}
+			tree.Insert(path[len(wrap):])
+			return false
+		})
+	}
+	return tree.List()
+}
+
+// unknownFindings reports the attributes that a policy tried to read but
+// that the schema doesn't allow, at the closest part of the template that
+// exists.
+func (scanner *Scanner) unknownFindings(source *Source, doc int, attempts PathTree) *Result {
+	result := &Result{
+		Query:      SchemaQuery,
+		Severity:   SeverityWarning,
+		File:       source.file,
+		Document:   doc,
+		Locations:  []Location{},
+		Unresolved: []Path{},
+		source:     source,
+	}
+	seen := PathTree{}
+	for _, path := range attempts.Paths() {
+		unknown := scanner.schema.Unknown(path)
+		if unknown == nil || seen.Contains(unknown) {
+			continue
+		}
+		seen.Insert(unknown)
+		finding := Finding{
+			Message:  fmt.Sprintf("the policy reads %s, which is not in the schema", unknown),
+			Severity: SeverityWarning,
+		}
+		// Usually the template doesn't have the attribute either, then we
+		// point to where it would be.
+		if location, _ := source.Resolve(doc, unknown); location != nil {
+			if scanner.relative {
+				location.Path = location.Path[len(scanner.root):]
+				location.arrays = location.arrays[len(scanner.root):]
+			}
+			finding.Locations = []Location{*location}
+		}
+		result.Findings = append(result.Findings, finding)
+		result.Locations = append(result.Locations, finding.Locations...)
+	}
+	result.Locations = sortLocations(result.Locations)
+	return result
+}
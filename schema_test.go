@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSchemaUnknown(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "schema.yml")
+	writeFile(t, file, `$defs:
+  container:
+    properties:
+      name: {type: string}
+      image: {type: string}
+properties:
+  spec:
+    properties:
+      replicas: {type: integer}
+      containers:
+        items: {$ref: "#/$defs/container"}
+      ports:
+        prefixItems: [{type: integer}]
+        items: false
+  metadata:
+    properties:
+      labels:
+        additionalProperties: {type: string}
+      annotations: {}
+    patternProperties:
+      "^x-": true
+`)
+	schema, err := LoadSchema(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path    Path
+		unknown Path
+	}{
+		{Path{"spec", "replicas"}, nil},
+		{Path{"spec", "replica"}, Path{"spec", "replica"}},
+		{Path{"spec", "containers", "0", "image"}, nil},
+		{Path{"spec", "containers", "1", "imgae"}, Path{"spec", "containers", "1", "imgae"}},
+		{Path{"spec", "ports", "0"}, nil},
+		{Path{"spec", "ports", "1"}, Path{"spec", "ports", "1"}},
+		{Path{"metadata", "labels", "app"}, nil},
+		{Path{"metadata", "annotations", "anything", "below"}, nil},
+		{Path{"metadata", "x-team"}, nil},
+		{Path{"metadata", "lables", "app"}, Path{"metadata", "lables"}},
+		{Path{"kind"}, Path{"kind"}},
+	} {
+		if unknown := schema.Unknown(test.path); !reflect.DeepEqual(unknown, test.unknown) {
+			t.Errorf("Unknown(%s) = %v, expected %v", test.path, unknown, test.unknown)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	writeFile(t, schema, `{"properties": {"spec": {"properties": {"replicas": {"type": "integer"}}}}}`)
+	options := Options{}
+	var err error
+	if options.Schema, err = LoadSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+	results, err := scan(t, `package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "too few replicas"
+}
+
+deny[msg] {
+	input.spec.replcas > 10
+	msg := "too many replicas"
+}
+`, "template.yml", "spec:\n  replicas: 1\n", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []Finding
+	for _, result := range results {
+		if result.Query == SchemaQuery {
+			warnings = append(warnings, result.Findings...)
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected a single schema warning, got %+v", warnings)
+	}
+	warning := warnings[0]
+	if warning.Severity != SeverityWarning || warning.Message != "the policy reads spec.replcas, which is not in the schema" {
+		t.Errorf("unexpected warning %+v", warning)
+	}
+	// The misspelled attribute doesn't exist, so it points to its parent.
+	if len(warning.Locations) != 1 || warning.Locations[0].Path.Pointer() != "/spec" {
+		t.Errorf("unexpected locations %+v", warning.Locations)
+	}
+}
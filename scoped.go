@@ -0,0 +1,267 @@
+package main
+
+import (
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// scopedTracer is like locationTracer, but only keeps the attributes used by
+// evaluations that make the query succeed.
+//
+// topdown evaluates queries depth-first.  Every expression gets an EvalOp
+// event when evaluation reaches it, a RedoOp event when it backtracks to try
+// the next solution of that expression, and a FailOp event when it has no
+// solutions.  We keep a stack of frames, one per expression currently being
+// evaluated, and discard frames when backtracking.  When the top-level query,
+// or a rule body it evaluates directly, exits, the frames on the stack
+// describe exactly how we got there.
+//
+// Not all backtracking is visible this way.  A reference like
+// `input.items[i].public` iterates over i within a single expression, so we
+// also roll back a frame when it binds a variable it had already bound.
+// Comprehensions and functions run in nested queries; when those exit, their
+// frames are copied into the expression that evaluated them.
+//
+// Like locationTracer, a scopedTracer is meant for a single evaluation.
+type scopedTracer struct {
+	started bool
+	root    uint64
+	frames  []scopedFrame
+	tree    PathTree
+	// The attributes that negated references didn't find.
+	missing PathTree
+	rules   []Rule
+	// The same rules as they are in the policy, e.g. for their annotations.
+	nodes []*ast.Rule
+	// The uses that ended up in the tree, for explain.
+	uses []scopedUse
+	// The query that started each nested query.
+	parents map[uint64]uint64
+	// Finds the paths used by a single event, reset for every event.
+	used *locationTracer
+}
+
+type scopedFrame struct {
+	query uint64
+	expr  *ast.Expr
+	paths []scopedUse
+	// Variables bound by this frame, and how many paths were used before.
+	marks []scopedMark
+}
+
+// scopedUse is a path that was used, with the expressions that were being
+// evaluated at the time, outermost first.
+type scopedUse struct {
+	path  Path
+	exprs []*ast.Expr
+	// Whether the path doesn't exist, see locationTracer.missing.
+	missing bool
+}
+
+type scopedMark struct {
+	v ast.Var
+	n int
+}
+
+func newScopedTracer(input *ast.Term, paths map[*ast.Location]Path) *scopedTracer {
+	used := newLocationTracer()
+	used.input, used.paths = input, paths
+	return &scopedTracer{tree: PathTree{}, missing: PathTree{}, used: used, parents: map[uint64]uint64{}}
+}
+
+func (tracer *scopedTracer) Enabled() bool {
+	return true
+}
+
+func (tracer *scopedTracer) Trace(event *topdown.Event) {
+	if !tracer.started {
+		tracer.started = true
+		tracer.root = event.QueryID
+	}
+	tracer.parents[event.QueryID] = event.ParentID
+
+	expr, _ := event.Node.(*ast.Expr)
+	switch event.Op {
+	case topdown.EvalOp:
+		tracer.frames = append(tracer.frames, scopedFrame{
+			query: event.QueryID,
+			expr:  expr,
+		})
+	case topdown.RedoOp:
+		if i := tracer.find(event.QueryID, expr); i >= 0 {
+			tracer.frames[i].paths = nil
+			tracer.frames[i].marks = nil
+			tracer.frames = tracer.frames[:i+1]
+		}
+		return
+	case topdown.FailOp:
+		if i := tracer.find(event.QueryID, expr); i >= 0 {
+			tracer.frames = tracer.frames[:i]
+		}
+		return
+	case topdown.ExitOp:
+		if event.QueryID == tracer.root || event.ParentID == tracer.root {
+			// Frames of other queries may be left over from solutions
+			// we backtracked over; nested queries that succeeded were
+			// copied into the frames of these two already.
+			for _, frame := range tracer.frames {
+				if frame.query != tracer.root && frame.query != event.QueryID {
+					continue
+				}
+				for _, use := range frame.paths {
+					if use.missing {
+						tracer.missing.Insert(use.path)
+					} else {
+						tracer.tree.Insert(use.path)
+					}
+				}
+				tracer.uses = append(tracer.uses, frame.paths...)
+			}
+			if rule, ok := event.Node.(*ast.Rule); ok {
+				tracer.rule(rule)
+			}
+		} else {
+			tracer.exit(event.QueryID)
+		}
+		return
+	}
+
+	if len(tracer.frames) > 0 {
+		frame := &tracer.frames[len(tracer.frames)-1]
+		if event.Op == topdown.UnifyOp && expr != nil {
+			for _, operand := range expr.Operands() {
+				if v, ok := operand.Value.(ast.Var); ok {
+					frame.bind(v)
+				}
+			}
+		}
+		tracer.used.reset()
+		tracer.used.Trace(event)
+		if len(tracer.used.tree) > 0 || len(tracer.used.missing) > 0 {
+			exprs := tracer.exprs(event.QueryID, expr)
+			for _, path := range tracer.used.tree.List() {
+				frame.paths = append(frame.paths, scopedUse{path: path, exprs: exprs})
+			}
+			for _, path := range tracer.used.missing.List() {
+				frame.paths = append(frame.paths, scopedUse{path: path, exprs: exprs, missing: true})
+			}
+		}
+	}
+}
+
+// bind records that a frame binds a variable.  Unify events show terms with
+// the current bindings applied, so a variable only shows up when it is not
+// bound yet.  If the frame bound it before, evaluation backtracked to that
+// point and we drop the uses since.
+func (frame *scopedFrame) bind(v ast.Var) {
+	for i, mark := range frame.marks {
+		if mark.v.Equal(v) {
+			frame.paths = frame.paths[:mark.n]
+			frame.marks = frame.marks[:i]
+			break
+		}
+	}
+	frame.marks = append(frame.marks, scopedMark{v: v, n: len(frame.paths)})
+}
+
+// exit copies the uses of a nested query that succeeded into the frame that
+// evaluated it.  The frames of the nested query stay on the stack, since it
+// may still be asked for more solutions.
+func (tracer *scopedTracer) exit(query uint64) {
+	for i, frame := range tracer.frames {
+		if frame.query != query {
+			continue
+		}
+		if i > 0 {
+			parent := &tracer.frames[i-1]
+			for _, nested := range tracer.frames[i:] {
+				parent.paths = append(parent.paths, nested.paths...)
+			}
+		}
+		return
+	}
+}
+
+// exprs lists the expressions that led to an event in a query: the
+// expression being evaluated in the query and the queries that started it,
+// up to the rule body, outermost first.  Stale frames of queries we
+// backtracked over may still be on the stack, so we follow the parents
+// rather than taking every frame.
+func (tracer *scopedTracer) exprs(query uint64, current *ast.Expr) []*ast.Expr {
+	exprs := []*ast.Expr{}
+	if current != nil {
+		exprs = append(exprs, current)
+	}
+	for ; query != tracer.root; query = tracer.parents[query] {
+		i := len(tracer.frames) - 1
+		for i >= 0 && tracer.frames[i].query != query {
+			i--
+		}
+		if i < 0 {
+			break
+		}
+		if expr := tracer.frames[i].expr; expr != nil && expr != current {
+			exprs = append([]*ast.Expr{expr}, exprs...)
+		}
+	}
+	return exprs
+}
+
+// explain returns the expressions that used a path, in the order they were
+// evaluated, see Options.Explain.
+func (tracer *scopedTracer) explain(path Path) []Step {
+	steps := []Step{}
+	seen := map[*ast.Expr]bool{}
+	for _, use := range tracer.uses {
+		if comparePaths(use.path, path) != 0 {
+			continue
+		}
+		for _, expr := range use.exprs {
+			if seen[expr] || expr.Location == nil {
+				continue
+			}
+			seen[expr] = true
+			text := string(expr.Location.Text)
+			if text == "" {
+				text = expr.String()
+			}
+			steps = append(steps, Step{
+				Expr:   text,
+				File:   expr.Location.File,
+				Line:   expr.Location.Row,
+				Column: expr.Location.Col,
+			})
+		}
+	}
+	return steps
+}
+
+// rule records a rule whose body the query evaluated successfully.
+func (tracer *scopedTracer) rule(rule *ast.Rule) {
+	if rule.Location == nil {
+		return
+	}
+	r := Rule{
+		Name:   rule.Head.Ref().String(),
+		File:   rule.Location.File,
+		Line:   rule.Location.Row,
+		Column: rule.Location.Col,
+	}
+	for _, seen := range tracer.rules {
+		if seen.Name == r.Name && seen.File == r.File && seen.Line == r.Line && seen.Column == r.Column {
+			return
+		}
+	}
+	tracer.rules = append(tracer.rules, r)
+	tracer.nodes = append(tracer.nodes, rule)
+}
+
+// find returns the index of the innermost frame for an expression, or -1.
+func (tracer *scopedTracer) find(query uint64, expr *ast.Expr) int {
+	for i := len(tracer.frames) - 1; i >= 0; i-- {
+		if frame := tracer.frames[i]; frame.query == query && frame.expr == expr {
+			return i
+		}
+	}
+	return -1
+}
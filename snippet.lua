@@ -16,7 +16,8 @@ function CodeBlock(cb)
     for line in io.open(cb.attributes.snippet, "r"):lines() do
       if line:startswith(cb.text) then
         snippet[#snippet + 1] = line
-        if line:endswith("{") then
+        -- Signatures may continue on the next lines.
+        if line:endswith("{") or line:endswith("(") then
           inbraces = true
         end
       elseif inbraces then
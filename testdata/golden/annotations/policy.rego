@@ -0,0 +1,15 @@
+# METADATA
+# title: Storage
+# custom:
+#   team: platform
+package storage
+
+# METADATA
+# title: Public buckets
+# description: Buckets must not be readable by everyone.
+# custom:
+#   severity: warning
+deny[msg] {
+	input.bucket.acl == "public-read"
+	msg := "bucket is public"
+}
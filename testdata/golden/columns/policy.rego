@@ -0,0 +1,16 @@
+package policy
+
+deny[msg] {
+	input.spec.replicas < 2
+	msg := "run at least two replicas"
+}
+
+warn[msg] {
+	endswith(input.spec.image, ":latest")
+	msg := "pin the image"
+}
+
+deny[msg] {
+	startswith(input.spec.command, "curl")
+	msg := "don't download anything"
+}
@@ -0,0 +1,10 @@
+package policy
+
+deny[msg] {
+	exposed(input.spec.ports[_])
+	msg := "exposes a privileged port"
+}
+
+exposed(port) {
+	port < 1024
+}
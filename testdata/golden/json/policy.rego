@@ -0,0 +1,6 @@
+package policy
+
+deny[msg] {
+	input.spec.containers[i].securityContext.privileged
+	msg := sprintf("container %d is privileged", [i])
+}
@@ -0,0 +1,6 @@
+package policy
+
+deny[msg] {
+	input.metadata.annotations["deprecated.example.com/owner"]
+	msg := "use the owner label instead"
+}
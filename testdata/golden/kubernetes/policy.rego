@@ -0,0 +1,14 @@
+package kubernetes
+
+deny[msg] {
+	input.kind == "Deployment"
+	container := input.spec.template.spec.containers[_]
+	endswith(container.image, ":latest")
+	msg := sprintf("%s uses the latest tag", [container.name])
+}
+
+deny[msg] {
+	input.kind == "Service"
+	input.spec.type == "NodePort"
+	msg := "services should not use a NodePort"
+}
@@ -0,0 +1,13 @@
+package policy
+
+deny[msg] {
+	container := input.spec.containers[_]
+	endswith(container.image, ":latest")
+	msg := sprintf("%s uses the latest tag", [container.name])
+}
+
+deny[msg] {
+	port := input.spec.ports[_]
+	port < 1024
+	msg := sprintf("port %d is privileged", [port])
+}
@@ -0,0 +1,6 @@
+package policy
+
+deny[msg] {
+	not input.primary.encrypted
+	msg := "primary is not encrypted"
+}
@@ -0,0 +1,6 @@
+package foo.bar
+
+violation[msg] {
+	input.owner == ""
+	msg := "owner is empty"
+}
@@ -0,0 +1,11 @@
+package policy
+
+deny[msg] {
+	input.spec.privileged
+	msg := "privileged"
+}
+
+audit[msg] {
+	input.metadata.owner == "nobody"
+	msg := "no owner"
+}
@@ -0,0 +1,9 @@
+package policy
+
+deny[msg] {
+	input.single == "a"
+	input.double == "b"
+	input.plain == "c"
+	input["with: colon"] == "d"
+	msg := "quoted"
+}
@@ -0,0 +1,11 @@
+package policy
+
+deny[msg] {
+	input.replicas < 2
+	msg := "at least two replicas are needed"
+}
+
+deny[msg] {
+	not input.enabled
+	msg := "the service is disabled"
+}
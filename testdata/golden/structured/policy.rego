@@ -0,0 +1,16 @@
+package policy
+
+deny[{"msg": msg, "severity": "warning", "id": "R001"}] {
+	input.spec.replicas < 2
+	msg := "run at least two replicas"
+}
+
+deny[msg] {
+	input.spec.ports[_] == 80
+	msg := "plain http"
+}
+
+warn[msg] {
+	count(input.spec.ports) > 1
+	msg := "more than one port"
+}
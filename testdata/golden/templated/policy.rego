@@ -0,0 +1,7 @@
+package templated
+
+deny[msg] {
+	input.kind == "Deployment"
+	input.spec.replicas < 2
+	msg := "run at least two replicas"
+}
@@ -0,0 +1,7 @@
+package policy
+
+deny[msg] {
+	bucket := input.resource.aws_s3_bucket[name]
+	bucket.acl == "public-read"
+	msg := sprintf("%s is public", [name])
+}
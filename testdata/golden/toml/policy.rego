@@ -0,0 +1,6 @@
+package policy
+
+deny[msg] {
+	input.server.port < 1024
+	msg := "the server uses a privileged port"
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+)
+
+// isTOML checks whether a file should be parsed as TOML rather than YAML.
+func isTOML(file string) bool {
+	return extension(file) == ".toml"
+}
+
+// tomlBuilder converts a TOML document to a tree of YAML nodes, so
+// Source.Location works the same way for both, and the input is decoded from
+// the same nodes as for YAML.  Scalars get a tag and a value that yaml.v3
+// decodes to what they mean in TOML.  yaml.v3 counts columns in
+// characters and the TOML parser in bytes, so we compute positions from
+// offsets ourselves.  Since the end positions are known exactly, we store
+// them in the source rather than recovering them from the text.
+type tomlBuilder struct {
+	source *Source
+	parser unstable.Parser
+	root   *yaml.Node
+	// Offset just after the last node we saw, used to find arrays, which
+	// don't carry a position.
+	offset int
+	// Tables defined by a `[a.b]` header, which may only appear once.
+	tables map[*yaml.Node]bool
+	// First error that the parser doesn't catch.
+	err error
+}
+
+// parseTOML builds the single document of a TOML source.
+func (source *Source) parseTOML() error {
+	builder := &tomlBuilder{source: source, tables: map[*yaml.Node]bool{}}
+	builder.parser.Reset(source.bytes)
+	builder.root = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: 1, Column: 1}
+	current := builder.root
+	empty := true
+	for builder.parser.NextExpression() {
+		expr := builder.parser.Expression()
+		switch expr.Kind {
+		case unstable.Table:
+			key := expr.Key()
+			current = builder.table(builder.root, &key, false)
+		case unstable.ArrayTable:
+			key := expr.Key()
+			current = builder.table(builder.root, &key, true)
+		case unstable.KeyValue:
+			key := expr.Key()
+			builder.keyValue(current, &key, expr.Value())
+		default:
+			continue
+		}
+		empty = false
+	}
+	if err := builder.parser.Error(); err != nil {
+		return err
+	} else if builder.err != nil {
+		return builder.err
+	}
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Line: 1, Column: 1}
+	if !empty {
+		doc.Content = []*yaml.Node{builder.root}
+	}
+	source.docs = append(source.docs, doc)
+	return nil
+}
+
+// table finds or creates the table for a `[a.b]` or `[[a.b]]` header.
+func (builder *tomlBuilder) table(mapping *yaml.Node, key *unstable.Iterator, array bool) *yaml.Node {
+	line := 0
+	for key.Next() {
+		k := builder.key(key.Node())
+		line = k.Line
+		_, child, _ := lookup(mapping, k.Value)
+		if key.IsLast() && array {
+			if child == nil {
+				child = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: k.Line, Column: k.Column}
+				mapping.Content = append(mapping.Content, k, child)
+			}
+			table := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: k.Line, Column: k.Column}
+			child.Content = append(child.Content, table)
+			return table
+		}
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: k.Line, Column: k.Column}
+			mapping.Content = append(mapping.Content, k, child)
+		} else if child.Kind == yaml.SequenceNode && len(child.Content) > 0 {
+			// `[a.b]` after `[[a]]` extends the last element.
+			child = child.Content[len(child.Content)-1]
+		}
+		mapping = child
+	}
+	if builder.tables[mapping] && builder.err == nil {
+		builder.err = fmt.Errorf("line %d: table already defined at line %d", line, mapping.Line)
+	}
+	builder.tables[mapping] = true
+	return mapping
+}
+
+// keyValue adds `a.b = value` to a table.
+func (builder *tomlBuilder) keyValue(mapping *yaml.Node, key *unstable.Iterator, value *unstable.Node) {
+	for key.Next() {
+		k := builder.key(key.Node())
+		if key.IsLast() {
+			mapping.Content = append(mapping.Content, k, builder.value(value))
+			return
+		}
+		_, child, _ := lookup(mapping, k.Value)
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: k.Line, Column: k.Column}
+			mapping.Content = append(mapping.Content, k, child)
+		}
+		mapping = child
+	}
+}
+
+func (builder *tomlBuilder) key(key *unstable.Node) *yaml.Node {
+	node := builder.scalar(key.Raw)
+	node.Tag, node.Value = "!!str", string(key.Data)
+	return node
+}
+
+func (builder *tomlBuilder) value(value *unstable.Node) *yaml.Node {
+	switch value.Kind {
+	case unstable.Array:
+		// Arrays don't have a position, so look for the opening bracket.
+		start := builder.offset + bytes.IndexByte(builder.source.bytes[builder.offset:], '[')
+		node := builder.node(start)
+		node.Kind, node.Tag, node.Style = yaml.SequenceNode, "!!seq", yaml.FlowStyle
+		children := value.Children()
+		for children.Next() {
+			if children.Node().Kind != unstable.Comment {
+				node.Content = append(node.Content, builder.value(children.Node()))
+			}
+		}
+		return node
+	case unstable.InlineTable:
+		node := builder.node(int(value.Raw.Offset))
+		node.Kind, node.Tag, node.Style = yaml.MappingNode, "!!map", yaml.FlowStyle
+		children := value.Children()
+		for children.Next() {
+			key := children.Node().Key()
+			builder.keyValue(node, &key, children.Node().Value())
+		}
+		return node
+	}
+
+	raw := value.Raw
+	if raw.Length == 0 {
+		// E.g. booleans only refer to their data.
+		raw = builder.parser.Range(value.Data)
+	}
+	node := builder.scalar(raw)
+	if err := scalarValue(node, value); err != nil && builder.err == nil {
+		builder.err = err
+	}
+	if value.Kind == unstable.String && builder.source.bytes[raw.Offset] == '"' {
+		if !bytes.HasPrefix(builder.parser.Raw(raw), []byte(`"""`)) {
+			node.Style = yaml.DoubleQuotedStyle
+		}
+	} else if value.Kind == unstable.String {
+		if !bytes.HasPrefix(builder.parser.Raw(raw), []byte(`'''`)) {
+			node.Style = yaml.SingleQuotedStyle
+		}
+	}
+	return node
+}
+
+// scalarValue sets the tag and value of a scalar node.  Numbers are normalized,
+// since YAML doesn't support e.g. `0o755` or `inf`.  Dates and times stay
+// strings, in RFC 3339 format.
+func scalarValue(node *yaml.Node, value *unstable.Node) error {
+	data := string(value.Data)
+	switch value.Kind {
+	case unstable.Bool:
+		node.Tag, node.Value = "!!bool", data
+	case unstable.Integer:
+		i, err := strconv.ParseInt(data, 0, 64)
+		if err != nil {
+			return err
+		}
+		node.Tag, node.Value = "!!int", strconv.FormatInt(i, 10)
+	case unstable.Float:
+		node.Tag = "!!float"
+		switch strings.TrimPrefix(data, "+") {
+		case "inf":
+			node.Value = ".inf"
+		case "-inf":
+			node.Value = "-.inf"
+		case "nan", "-nan":
+			node.Value = ".nan"
+		default:
+			f, err := strconv.ParseFloat(strings.ReplaceAll(data, "_", ""), 64)
+			if err != nil {
+				return err
+			}
+			node.Value = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	case unstable.DateTime:
+		t, err := time.Parse(time.RFC3339Nano, strings.ToUpper(strings.Replace(data, " ", "T", 1)))
+		if err != nil {
+			return err
+		}
+		node.Tag, node.Value = "!!str", t.Format(time.RFC3339Nano)
+	case unstable.LocalDateTime:
+		node.Tag, node.Value = "!!str", strings.ToUpper(strings.Replace(data, " ", "T", 1))
+	default:
+		node.Tag, node.Value = "!!str", data
+	}
+	return nil
+}
+
+// node creates a node for a collection starting at an offset.  Its end is
+// found by Source.end, like for YAML flow collections.
+func (builder *tomlBuilder) node(offset int) *yaml.Node {
+	node := &yaml.Node{}
+	node.Line, node.Column = builder.source.position(offset)
+	builder.offset = offset + 1
+	return node
+}
+
+// scalar creates a node spanning a range of the input.
+func (builder *tomlBuilder) scalar(raw unstable.Range) *yaml.Node {
+	start, end := int(raw.Offset), int(raw.Offset+raw.Length)
+	node := &yaml.Node{Kind: yaml.ScalarNode}
+	node.Line, node.Column = builder.source.position(start)
+	endLine, endColumn := builder.source.position(end)
+	builder.source.ends[node] = [2]int{endLine, endColumn}
+	builder.offset = end
+	return node
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+func TestTOML(t *testing.T) {
+	findings := infer(t, `package policy
+
+deny[msg] {
+	input.server.port < 1024
+	msg := "privileged port"
+}
+
+deny[msg] {
+	user := input.users[_]
+	user.admin
+	msg := sprintf("%s is an admin", [user.name])
+}
+`, "config.toml", `title = "example"
+
+[server]
+host = "localhost"
+port = 80
+
+[[users]]
+name = "alice"
+admin = false
+
+[[users]]
+name = "bob"
+admin = true
+`, Options{})
+	expected := map[string][]string{
+		"privileged port": {"server.port@5:8"},
+		"bob is an admin": {"users[1].name@12:9", "users[1].admin@13:9"},
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("got %v, expected %v", findings, expected)
+	}
+}
+
+// TestTOMLDecode checks that the input decoded from the nodes of a TOML
+// template is the same as what the TOML library decodes.
+func TestTOMLDecode(t *testing.T) {
+	text := `mode = 0o755
+count = 1_000
+hex = 0xff
+ratio = 1.5e3
+enabled = true
+name = 'literal \n'
+created = 1979-05-27T07:32:00-08:00
+local = 1979-05-27 07:32:00
+ports = [80, 443]
+point = {x = 1, y = -2.5}
+
+[[users]]
+name = "alice"
+`
+	var expected map[string]interface{}
+	if err := toml.Unmarshal([]byte(text), &expected); err != nil {
+		t.Fatal(err)
+	}
+	var got interface{}
+	if err := testSource(t, "config.toml", text).docs[0].Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := jsonString(t, got), jsonString(t, expected); a != b {
+		t.Errorf("got %s, expected %s", a, b)
+	}
+
+	// The unstable parser allows a table to be defined twice.
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "twice.toml"), "[a]\nx = 1\n\n[a]\ny = 2\n")
+	if _, err := newSource(filepath.Join(dir, "twice.toml"), false, false); err == nil || !strings.Contains(err.Error(), "line 4: table already defined at line 1") {
+		t.Errorf("expected an error for the second [a], got %v", err)
+	}
+}
+
+// jsonString encodes a value as JSON, so numbers and times can be compared
+// regardless of their Go types.
+func jsonString(t *testing.T, value interface{}) string {
+	t.Helper()
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bytes)
+}